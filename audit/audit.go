@@ -0,0 +1,322 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package audit maintains an append-only, tamper-evident log of every write that the arbitrator sends to a mysqld.
+Each record holds the SHA-256 hash of the previous record, and its own hash covers that along with all of its
+contents. So any record that's changed, removed, or reordered breaks the chain from that point on.
+*/
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ResultOK is the result recorded when the statement succeeded
+const ResultOK = "OK"
+
+// ResultPending is the result of an attempt record, which is written right before the statement is sent
+const ResultPending = "PENDING"
+
+// The phases of a statement, each one has an attempt record followed by a result record
+const (
+	PhaseAttempt = "attempt"
+	PhaseResult  = "result"
+)
+
+// the previous hash used by the very first record in the log
+const genesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Record is one mutating statement sent to a mysqld
+type Record struct {
+	Sequence   uint64 `json:"seq"`
+	Time       string `json:"time"`
+	DecisionID string `json:"decision_id,omitempty"`
+	Node       string `json:"node"`
+	ServerUUID string `json:"server_uuid,omitempty"`
+	Statement  string `json:"statement"`
+	Reason     string `json:"reason,omitempty"`
+	// Snapshot is the JSON encoded view of the cluster that justified the statement
+	Snapshot json.RawMessage `json:"snapshot,omitempty"`
+	// Phase is if the record is the attempt at the statement or its result, it's empty in logs from before that
+	Phase    string `json:"phase,omitempty"`
+	Result   string `json:"result"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// Log is an open audit log file
+type Log struct {
+	mu       sync.Mutex
+	file     *os.File
+	seq      uint64
+	lastHash string
+}
+
+/*
+Open opens the audit log for appending, creating it if needed. The chain is continued from the last record. If we
+were killed while that record was being written, the partial record is moved to a quarantine file next to the log,
+as there's no way to complete it, and the chain is then verified without it.
+*/
+func Open(path string, logger *slog.Logger) (*Log, error) {
+	quarantine, torn, err := repairTornRecord(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not repair the torn record at the end of the audit log %s: %v", path, err)
+	}
+
+	if torn > 0 {
+		logger.Warn("Moved a torn record at the end of the audit log, which was cut off while being written, to the quarantine file", "file", path, "quarantine", quarantine, "bytes", torn)
+	}
+
+	count, lastHash, err := Verify(path)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Refusing to append to the audit log %s as its chain is broken: %v", path, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Log{file: file, seq: count, lastHash: lastHash}, nil
+}
+
+// Append completes the record's sequence, time, and hashes, then durably writes it to the log
+func (l *Log) Append(rec Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return errors.New("The audit log has been closed!")
+	}
+
+	rec.Sequence = l.seq + 1
+	rec.PrevHash = l.lastHash
+
+	if rec.Time == "" {
+		rec.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+
+	hash, err := hashRecord(rec)
+
+	if err != nil {
+		return err
+	}
+
+	rec.Hash = hash
+	line, err := json.Marshal(rec)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	// the whole point is to have a trace even if we're killed right after this, so let's make sure it's on disk
+	if err = l.file.Sync(); err != nil {
+		return err
+	}
+
+	l.seq = rec.Sequence
+	l.lastHash = rec.Hash
+
+	return nil
+}
+
+// Close closes the audit log file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
+
+// the suffix of the file, next to the audit log, where the torn records are kept
+const quarantineSuffix = ".torn"
+
+/*
+repairTornRecord truncates the log after its last complete line, as each record is written along with its newline,
+appending what's after it to the quarantine file. It returns the quarantine file and the size of the torn record.
+*/
+func repairTornRecord(path string) (string, int, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+
+	if os.IsNotExist(err) {
+		return "", 0, nil
+	}
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	// read backwards until we find the end of the last complete record, or the start of the file
+	end := info.Size()
+	offset := end
+	buf := make([]byte, 64*1024)
+
+	for offset > 0 {
+		n := int64(len(buf))
+
+		if n > offset {
+			n = offset
+		}
+
+		if _, err = file.ReadAt(buf[:n], offset-n); err != nil {
+			return "", 0, err
+		}
+
+		if nl := bytes.LastIndexByte(buf[:n], '\n'); nl != -1 {
+			offset = offset - n + int64(nl) + 1
+			break
+		}
+
+		offset -= n
+	}
+
+	if offset == end {
+		return "", 0, nil
+	}
+
+	torn := make([]byte, end-offset)
+
+	if _, err = file.ReadAt(torn, offset); err != nil {
+		return "", 0, err
+	}
+
+	quarantine := path + quarantineSuffix
+	qfile, err := os.OpenFile(quarantine, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	// the torn record must be safely kept before it's removed from the log
+	_, err = qfile.Write(append(torn, '\n'))
+
+	if err == nil {
+		err = qfile.Sync()
+	}
+
+	if cerr := qfile.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err = file.Truncate(offset); err != nil {
+		return "", 0, err
+	}
+
+	return quarantine, len(torn), file.Sync()
+}
+
+// hashRecord hashes the record's JSON encoding, without the hash itself, which includes the previous hash
+func hashRecord(rec Record) (string, error) {
+	rec.Hash = ""
+	contents, err := json.Marshal(rec)
+
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(contents)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Verify checks the hash chain of the audit log, returning the number of valid records and the last hash. The
+// error notes the first record where the chain is broken.
+func Verify(path string) (uint64, string, error) {
+	var count uint64
+	lastHash := genesisHash
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return 0, lastHash, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// the snapshots can make for long lines
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+
+	for scanner.Scan() {
+		var rec Record
+		line++
+
+		if err = json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return count, lastHash, fmt.Errorf("line %d: could not parse the record: %v", line, err)
+		}
+
+		if rec.Sequence != count+1 {
+			return count, lastHash, fmt.Errorf("line %d: expected sequence %d but found %d", line, count+1, rec.Sequence)
+		}
+
+		if rec.PrevHash != lastHash {
+			return count, lastHash, fmt.Errorf("line %d: the previous hash %s doesn't match the hash of the prior record %s", line, rec.PrevHash, lastHash)
+		}
+
+		hash, herr := hashRecord(rec)
+
+		if herr != nil {
+			return count, lastHash, fmt.Errorf("line %d: %v", line, herr)
+		}
+
+		if hash != rec.Hash {
+			return count, lastHash, fmt.Errorf("line %d: the record has been modified, its hash should be %s but is %s", line, hash, rec.Hash)
+		}
+
+		count++
+		lastHash = rec.Hash
+	}
+
+	return count, lastHash, scanner.Err()
+}
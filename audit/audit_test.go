@@ -0,0 +1,117 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// appendRecords opens the log and appends n records to it
+func appendRecords(t *testing.T, path string, n int) {
+	l, err := Open(path, testLog)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	for i := 0; i < n; i++ {
+		if err = l.Append(Record{Node: "hanode1:3306", Statement: "STOP GROUP_REPLICATION", Phase: PhaseAttempt, Result: ResultPending}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenTornRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		records int
+		torn    string
+	}{
+		{"torn after complete records", 2, `{"seq":3,"time":"2017-`},
+		{"only a torn record", 0, `{"seq":1,"ti`},
+		{"a record without its newline", 1, `{"seq":2}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			appendRecords(t, path, tt.records)
+
+			file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			file.WriteString(tt.torn)
+			file.Close()
+
+			if _, _, err = Verify(path); err == nil {
+				t.Fatal("expected the torn record to break the chain")
+			}
+
+			// the torn record is quarantined, and we carry on after the last complete record
+			appendRecords(t, path, 1)
+
+			count, _, err := Verify(path)
+
+			if err != nil || count != uint64(tt.records+1) {
+				t.Errorf("expected %d intact record(s), got %d: %v", tt.records+1, count, err)
+			}
+
+			quarantined, err := ioutil.ReadFile(path + quarantineSuffix)
+
+			if err != nil || !bytes.Equal(quarantined, []byte(tt.torn+"\n")) {
+				t.Errorf("expected the torn record %q to be quarantined, got %q: %v", tt.torn, quarantined, err)
+			}
+		})
+	}
+}
+
+func TestOpenBrokenChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	appendRecords(t, path, 2)
+
+	contents, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a complete record that's been tampered with isn't torn, so we refuse to append rather than repair it
+	if err = ioutil.WriteFile(path, bytes.Replace(contents, []byte("STOP"), []byte("STAR"), 1), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Open(path, testLog); err == nil {
+		t.Error("expected Open to refuse a log with a broken chain")
+	}
+
+	if _, err = os.Stat(path + quarantineSuffix); !os.IsNotExist(err) {
+		t.Errorf("nothing should have been quarantined: %v", err)
+	}
+}
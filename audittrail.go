@@ -0,0 +1,190 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattlord/myarbitratord/audit"
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// auditTrail is our group.Auditor, it records each mutation along with the decision and snapshot that justified it
+type auditTrail struct {
+	sync.Mutex
+	log        *audit.Log
+	decisionID string
+	reason     string
+	snapshot   json.RawMessage
+	// when the decision's actions began, and the last statement that was sent (and if it's still in flight)
+	started       time.Time
+	lastStatement string
+	// the first error writing to the audit log, after which we mustn't carry on making changes
+	writeErr error
+}
+
+var auditor = &auditTrail{}
+
+// justify notes why we're about to make the following mutations, it must be called before each action is taken
+func (me *auditTrail) justify(decisionID string, reason string, snap Snapshot) {
+	me.Lock()
+	defer me.Unlock()
+
+	if decisionID != me.decisionID {
+		me.started = time.Now()
+		me.lastStatement = ""
+	}
+
+	me.decisionID = decisionID
+	me.reason = reason
+	me.snapshot = nil
+
+	if me.log == nil {
+		return
+	}
+
+	snapJSON, err := json.Marshal(snap)
+
+	if err != nil {
+		Log.Error("Could not encode the snapshot for the audit log", logging.KeyDecisionID, decisionID, logging.KeyError, err)
+	}
+
+	me.snapshot = snapJSON
+}
+
+func (me *auditTrail) Attempt(node *group.Node, statement string) {
+	me.Lock()
+	defer me.Unlock()
+
+	me.lastStatement = node.MySQLHost + ":" + node.MySQLPort + ": " + statement + " (in flight)"
+
+	me.append(node, statement, audit.PhaseAttempt, audit.ResultPending)
+}
+
+func (me *auditTrail) Mutation(node *group.Node, statement string, result error) {
+	me.Lock()
+	defer me.Unlock()
+
+	me.lastStatement = node.MySQLHost + ":" + node.MySQLPort + ": " + statement
+
+	if result != nil {
+		me.append(node, statement, audit.PhaseResult, result.Error())
+	} else {
+		me.append(node, statement, audit.PhaseResult, audit.ResultOK)
+	}
+}
+
+// append writes the record for the statement to the audit log, the caller must hold the lock
+func (me *auditTrail) append(node *group.Node, statement string, phase string, result string) {
+	if me.log == nil {
+		return
+	}
+
+	rec := audit.Record{
+		DecisionID: me.decisionID,
+		Node:       node.MySQLHost + ":" + node.MySQLPort,
+		ServerUUID: node.ServerUuid,
+		Statement:  statement,
+		Reason:     me.reason,
+		Snapshot:   me.snapshot,
+		Phase:      phase,
+		Result:     result,
+	}
+
+	if err := me.log.Append(rec); err != nil {
+		nodeLogger(Log, node).Error("Could not write to the audit log", logging.KeyDecisionID, me.decisionID, "statement", statement, logging.KeyError, err)
+
+		if me.writeErr == nil {
+			me.writeErr = err
+		}
+	}
+}
+
+// failure returns the first error writing to the audit log, if there's been one
+func (me *auditTrail) failure() error {
+	me.Lock()
+	defer me.Unlock()
+
+	return me.writeErr
+}
+
+// settle notes that the actions for the current decision, if any, have all been carried out
+func (me *auditTrail) settle() {
+	me.Lock()
+	defer me.Unlock()
+
+	me.decisionID = ""
+	me.reason = ""
+	me.snapshot = nil
+	me.lastStatement = ""
+}
+
+// inFlight returns the log fields describing the decision whose actions are being carried out, if any
+func (me *auditTrail) inFlight() ([]interface{}, bool) {
+	me.Lock()
+	defer me.Unlock()
+
+	if me.decisionID == "" {
+		return nil, false
+	}
+
+	return []interface{}{logging.KeyDecisionID, me.decisionID, "reason", me.reason, "in_flight_for", time.Since(me.started).Round(time.Millisecond), "last_statement", me.lastStatement}, true
+}
+
+func (me *auditTrail) close() {
+	me.Lock()
+	defer me.Unlock()
+
+	if me.log != nil {
+		me.log.Close()
+		me.log = nil
+	}
+}
+
+// verifyAuditCommand checks the hash chain of an audit log, it's run via: myarbitratord verify-audit <file>
+func verifyAuditCommand(args []string) int {
+	cmdFlags := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	path := cmdFlags.String("file", "", "The audit log file to verify, it can also be given as an argument")
+	cmdFlags.Parse(args)
+
+	if *path == "" && cmdFlags.NArg() > 0 {
+		*path = cmdFlags.Arg(0)
+	}
+
+	if *path == "" {
+		fmt.Fprintf(os.Stderr, "Usage of %s verify-audit:\n", os.Args[0])
+		cmdFlags.PrintDefaults()
+		return 1
+	}
+
+	count, lastHash, err := audit.Verify(*path)
+
+	if err != nil {
+		fmt.Printf("FAILED: %s is not intact after %d valid record(s): %v\n", *path, count, err)
+		return 2
+	}
+
+	fmt.Printf("OK: %s is intact, %d record(s) verified, last hash: %s\n", *path, count, lastHash)
+
+	return 0
+}
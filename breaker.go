@@ -0,0 +1,231 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/notify"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// The kinds of destructive actions that the circuit breaker keeps track of
+const (
+	actionShutdown     = "shutdown"
+	actionForceMembers = "force_members"
+	actionEject        = "eject"
+)
+
+// the action budget, see the flags in main, where a limit of 0 means unlimited
+var (
+	maxShutdowns    = 0
+	maxForceMembers = 0
+	maxEjections    = 0
+	actionWindow    = time.Hour
+)
+
+// actionLimit returns the most actions of the kind allowed within the window, 0 meaning unlimited
+func actionLimit(kind string) int {
+	switch kind {
+	case actionShutdown:
+		return maxShutdowns
+	case actionForceMembers:
+		return maxForceMembers
+	case actionEject:
+		return maxEjections
+	}
+
+	return 0
+}
+
+// clusterBudget is the circuit breaker's state for one cluster, presented as JSON via the "/breaker" HTTP API call
+type clusterBudget struct {
+	// Actions are when each kind of action was taken within the window
+	Actions  map[string][]time.Time `json:"Actions"`
+	Open     bool                   `json:"Open"`
+	OpenedAt *time.Time             `json:"Opened At,omitempty"`
+	Reason   string                 `json:"Reason,omitempty"`
+}
+
+/*
+The circuit breaker stops a misbehaving network from having us shut down node after node. Each destructive action
+counts against a budget per cluster and, once it's used up, the breaker opens and we're advisory-only for the cluster:
+we still log what we would do, but no longer do it, until the breaker is reset via the "/breaker/reset" HTTP
+API call.
+*/
+var breaker = struct {
+	sync.Mutex
+	clusters map[string]*clusterBudget
+}{clusters: make(map[string]*clusterBudget)}
+
+/*
+allowAction tells us if we can take the action on the node, counting it against the cluster's budget when we can. The
+cluster is the seed node's group name, as a node that we couldn't connect to doesn't know which group it's in.
+*/
+func allowAction(logger *slog.Logger, kind string, cluster string, node *group.Node, decisionID string) bool {
+	now := time.Now()
+
+	breaker.Lock()
+	budget, ok := breaker.clusters[cluster]
+
+	if !ok {
+		budget = &clusterBudget{Actions: make(map[string][]time.Time)}
+		breaker.clusters[cluster] = budget
+	}
+
+	// forget about the actions that are no longer within the window
+	for k, taken := range budget.Actions {
+		recent := taken[:0]
+
+		for _, t := range taken {
+			if now.Sub(t) < actionWindow {
+				recent = append(recent, t)
+			}
+		}
+
+		budget.Actions[k] = recent
+	}
+
+	wasOpen := budget.Open
+	limit := actionLimit(kind)
+
+	if !budget.Open && limit > 0 && len(budget.Actions[kind]) >= limit {
+		budget.Open = true
+		budget.OpenedAt = &now
+		budget.Reason = fmt.Sprintf("%d %s actions were taken within %s, the most allowed", len(budget.Actions[kind]), kind, actionWindow)
+	}
+
+	open := budget.Open
+	reason := budget.Reason
+
+	if !open {
+		budget.Actions[kind] = append(budget.Actions[kind], now)
+	}
+	breaker.Unlock()
+
+	if !open {
+		return true
+	}
+
+	if !wasOpen {
+		logger.Error("The circuit breaker is open, we're now advisory-only for the cluster until it's reset", logging.KeyCluster, cluster, logging.KeyDecisionID, decisionID, "reason", reason)
+
+		ev := nodeEvent(notify.EventCircuitBreaker, notify.SeverityCritical, node, decisionID, "The circuit breaker is open, the arbitrator is now advisory-only for the cluster until it's reset: "+reason)
+		ev.Cluster = cluster
+		ev.Details["state"] = "open"
+		ev.Incident = breakerIncident(cluster)
+		events.Publish(ev)
+	}
+
+	nodeLogger(logger, node).Warn("Advisory only, the circuit breaker is open so we're not taking the action", logging.KeyDecisionID, decisionID, "action", kind, "reason", reason)
+
+	return false
+}
+
+// breakerState returns a copy of the circuit breaker's state for each cluster, to persist in the state file
+func breakerState() map[string]*clusterBudget {
+	breaker.Lock()
+	defer breaker.Unlock()
+
+	clusters := make(map[string]*clusterBudget, len(breaker.clusters))
+
+	for name, budget := range breaker.clusters {
+		saved := *budget
+		saved.Actions = make(map[string][]time.Time, len(budget.Actions))
+
+		for kind, taken := range budget.Actions {
+			saved.Actions[kind] = append([]time.Time(nil), taken...)
+		}
+
+		clusters[name] = &saved
+	}
+
+	return clusters
+}
+
+// resetBreaker closes the circuit breaker, and empties the budget, for the cluster or for all of them when it's empty
+func resetBreaker(cluster string) []string {
+	reset := []string{}
+
+	breaker.Lock()
+	for name, budget := range breaker.clusters {
+		if cluster == "" || cluster == name {
+			if budget.Open {
+				reset = append(reset, name)
+			}
+
+			breaker.clusters[name] = &clusterBudget{Actions: make(map[string][]time.Time)}
+		}
+	}
+	breaker.Unlock()
+
+	for _, name := range reset {
+		Log.Warn("The circuit breaker has been reset, we're taking actions again", logging.KeyCluster, name)
+
+		events.Publish(notify.Event{Type: notify.EventCircuitBreaker, Severity: notify.SeverityInfo, Cluster: name, Message: "The circuit breaker has been reset, the arbitrator is taking actions again", Details: map[string]interface{}{"state": "closed"}, Incident: breakerIncident(name), Resolved: true})
+	}
+
+	return reset
+}
+
+// This will serve the circuit breaker's state for each cluster via a simple RESTful API
+func breakerHandler(httpW http.ResponseWriter, httpR *http.Request) {
+	Log.Debug("Handling HTTP request for breaker")
+
+	breaker.Lock()
+	breakerJSON, err := json.MarshalIndent(breaker.clusters, "", "    ")
+	breaker.Unlock()
+
+	if err != nil {
+		Log.Error("Error handling HTTP request for breaker", logging.KeyError, err)
+	}
+
+	httpW.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(httpW, "%s", breakerJSON)
+}
+
+// This will reset the circuit breaker, for the ?cluster=<group name> or all of them, via a simple RESTful API
+func breakerResetHandler(httpW http.ResponseWriter, httpR *http.Request) {
+	if httpR.Method != http.MethodPost {
+		httpW.Header().Set("Allow", http.MethodPost)
+		http.Error(httpW, "The breaker can only be reset with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cluster := httpR.URL.Query().Get("cluster")
+	Log.Info("Handling HTTP request to reset the breaker", logging.KeyCluster, cluster, "remote_addr", httpR.RemoteAddr)
+
+	resetJSON, err := json.MarshalIndent(map[string][]string{"Reset": resetBreaker(cluster)}, "", "    ")
+
+	if err != nil {
+		Log.Error("Error handling HTTP request to reset the breaker", logging.KeyError, err)
+	}
+
+	httpW.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(httpW, "%s", resetJSON)
+}
+
+// breakerIncident ties the notifications about a cluster's circuit breaker opening and being reset together
+func breakerIncident(cluster string) string {
+	return notify.EventCircuitBreaker + ":" + cluster
+}
@@ -0,0 +1,344 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package credentials
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Credentials is a MySQL account. The password is masked whenever the value is formatted, so it's safe to log.
+type Credentials struct {
+	User     string
+	Password string
+	// Source notes where the credentials were read from, e.g. "option file /etc/myarbitratord.cnf"
+	Source string
+}
+
+// Config specifies where we can look for credentials. Anything left empty is simply skipped.
+type Config struct {
+	// User and Password are the values from the command-line, UserSet notes if the user was explicitly specified
+	User     string
+	UserSet  bool
+	Password string
+
+	// AuthFile is our own JSON encoded file: {"user": "myuser", "password": "mypass"}
+	AuthFile string
+
+	// DefaultsFile is a MySQL option file, read instead of ~/.my.cnf when specified
+	DefaultsFile string
+	// DefaultsGroups are the option file groups to read after [client], later ones take precedence
+	DefaultsGroups []string
+
+	// CredentialsDir holds one file per secret, named "user" and "password" (e.g. systemd's $CREDENTIALS_DIRECTORY)
+	CredentialsDir string
+}
+
+// The environment variables that we'll check for credentials
+const (
+	EnvUser     = "MYARBITRATORD_MYSQL_USER"
+	EnvPassword = "MYARBITRATORD_MYSQL_PASSWORD"
+	// the standard variable used by the mysql client
+	EnvMySQLPassword = "MYSQL_PWD"
+	// set by systemd when the unit uses LoadCredential= or SetCredential=
+	EnvCredentialsDir = "CREDENTIALS_DIRECTORY"
+)
+
+// DefaultUser is used when no source specifies a user
+const DefaultUser = "root"
+
+// the masked value shown in place of a password
+const passwordMask = "********"
+
+func (c Credentials) String() string {
+	pass := ""
+
+	if c.Password != "" {
+		pass = passwordMask
+	}
+
+	return fmt.Sprintf("{User:%s Password:%s Source:%s}", c.User, pass, c.Source)
+}
+
+func (c Credentials) GoString() string {
+	return c.String()
+}
+
+// MarshalJSON ensures that the password can't leak out via the RESTful API either
+func (c Credentials) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		User   string `json:"User"`
+		Source string `json:"Source,omitempty"`
+	}{c.User, c.Source})
+}
+
+/*
+Load resolves the credentials from the sources in the config. Sources that were explicitly specified take
+precedence over the ambient ones, so the first source which provides a password wins:
+ 1. the -mysql-password command-line flag
+ 2. the JSON encoded -mysql-auth-file
+ 3. the MySQL option file given with -mysql-defaults-file
+ 4. the file-per-secret credentials directory (-mysql-credentials-dir or $CREDENTIALS_DIRECTORY)
+ 5. the MYARBITRATORD_MYSQL_USER/MYARBITRATORD_MYSQL_PASSWORD or MYSQL_PWD environment variables
+ 6. ~/.my.cnf (only when no -mysql-defaults-file was specified)
+
+The user comes from the command-line when it was explicitly specified there, otherwise from the winning source.
+*/
+func Load(cfg Config) (Credentials, error) {
+	var creds Credentials
+	var err error
+
+	groups := append([]string{"client"}, cfg.DefaultsGroups...)
+
+	sources := []func() (Credentials, error){
+		func() (Credentials, error) {
+			return Credentials{User: cfg.User, Password: cfg.Password, Source: "command-line"}, nil
+		},
+		func() (Credentials, error) {
+			return readAuthFile(cfg.AuthFile)
+		},
+		func() (Credentials, error) {
+			return readOptionFileCredentials(cfg.DefaultsFile, groups)
+		},
+		func() (Credentials, error) {
+			dir := cfg.CredentialsDir
+			if dir == "" {
+				dir = os.Getenv(EnvCredentialsDir)
+			}
+			return readCredentialsDir(dir)
+		},
+		readEnvironment,
+		func() (Credentials, error) {
+			if cfg.DefaultsFile != "" {
+				return Credentials{}, nil
+			}
+			home, herr := os.UserHomeDir()
+			if herr != nil {
+				return Credentials{}, nil
+			}
+			path := filepath.Join(home, ".my.cnf")
+			// a missing ~/.my.cnf is perfectly normal
+			if _, serr := os.Stat(path); serr != nil {
+				return Credentials{}, nil
+			}
+			return readOptionFileCredentials(path, groups)
+		},
+	}
+
+	for _, source := range sources {
+		creds, err = source()
+
+		if err != nil {
+			return Credentials{}, err
+		}
+
+		if creds.Password != "" {
+			break
+		}
+	}
+
+	if creds.Password == "" {
+		creds = Credentials{Source: "none"}
+	}
+
+	if cfg.UserSet || creds.User == "" {
+		creds.User = cfg.User
+	}
+
+	if creds.User == "" {
+		creds.User = DefaultUser
+	}
+
+	return creds, nil
+}
+
+func readAuthFile(path string) (Credentials, error) {
+	type JSONMySQLAuth struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+	}
+
+	var JSONAuth JSONMySQLAuth
+
+	if path == "" {
+		return Credentials{}, nil
+	}
+
+	JSONFile, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return Credentials{}, errors.New("Could not read mysql credentials from specified file: " + path)
+	}
+
+	err = json.Unmarshal(JSONFile, &JSONAuth)
+
+	if err != nil || JSONAuth.User == "" || JSONAuth.Password == "" {
+		errstr := "Failed to read user and password from " + path + ". Ensure that the file contents are in the required format: \n{\n  \"user\": \"myser\",\n  \"password\": \"mypass\"\n}"
+		return Credentials{}, errors.New(errstr)
+	}
+
+	return Credentials{User: JSONAuth.User, Password: JSONAuth.Password, Source: "auth file " + path}, nil
+}
+
+func readOptionFileCredentials(path string, groups []string) (Credentials, error) {
+	if path == "" {
+		return Credentials{}, nil
+	}
+
+	user, password, err := ReadOptionFile(path, groups)
+
+	if err != nil {
+		return Credentials{}, fmt.Errorf("Could not read mysql credentials from option file %s: %v", path, err)
+	}
+
+	return Credentials{User: user, Password: password, Source: "option file " + path + " [" + strings.Join(groups, ",") + "]"}, nil
+}
+
+func readCredentialsDir(dir string) (Credentials, error) {
+	if dir == "" {
+		return Credentials{}, nil
+	}
+
+	var creds Credentials
+
+	// we'll accept both the short and the more explicit names, as systemd credentials are often shared between services
+	for _, secret := range []struct {
+		names []string
+		val   *string
+	}{{[]string{"mysql-user", "user"}, &creds.User}, {[]string{"mysql-password", "password"}, &creds.Password}} {
+		for _, name := range secret.names {
+			path := filepath.Join(dir, name)
+			val, err := ReadSecretFile(path)
+
+			// only the secrets that aren't there at all are optional, anything else is most likely a permissions problem
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			if err != nil {
+				return Credentials{}, fmt.Errorf("Could not read mysql credentials from the credentials directory: %v", err)
+			}
+
+			if val != "" {
+				*secret.val = val
+				break
+			}
+		}
+	}
+
+	creds.Source = "credentials directory " + dir
+
+	return creds, nil
+}
+
+// ReadSecretFile returns the contents of the file without the trailing newline that editors like to add
+func ReadSecretFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+
+	return strings.TrimRight(string(contents), "\r\n"), err
+}
+
+func readEnvironment() (Credentials, error) {
+	creds := Credentials{User: os.Getenv(EnvUser), Password: os.Getenv(EnvPassword), Source: "environment"}
+
+	if creds.Password == "" {
+		creds.Password = os.Getenv(EnvMySQLPassword)
+	}
+
+	return creds, nil
+}
+
+/*
+Override gives the credentials to be used for the nodes it matches, rather than the cluster wide ones. Only one of
+ServerUUID, Endpoint ("host:port") or Label (a shell pattern such as "dmz-*") should be specified. When a node
+matches more than one, the most specific match wins: the server UUID, then the endpoint, then the label.
+*/
+type Override struct {
+	ServerUUID string `json:"server_uuid,omitempty"`
+	Endpoint   string `json:"endpoint,omitempty"`
+	Label      string `json:"label,omitempty"`
+	User       string `json:"user"`
+	Password   string `json:"password"`
+}
+
+func (o Override) String() string {
+	pass := ""
+
+	if o.Password != "" {
+		pass = passwordMask
+	}
+
+	return fmt.Sprintf("{ServerUUID:%s Endpoint:%s Label:%s User:%s Password:%s}", o.ServerUUID, o.Endpoint, o.Label, o.User, pass)
+}
+
+func (o Override) GoString() string {
+	return o.String()
+}
+
+/*
+LoadOverrides reads the per-node credentials from a JSON encoded file. The format of that file being:
+
+	[
+	  {"server_uuid": "de6858e8-0669-4b82-a188-d2906daa6d91", "user": "arbitrator", "password": "secret1"},
+	  {"endpoint": "hanode4:3306", "user": "arbitrator", "password": "secret2"},
+	  {"label": "dmz-*", "user": "dmz_arbitrator", "password": "secret3"}
+	]
+*/
+func LoadOverrides(path string) ([]Override, error) {
+	var overrides []Override
+
+	if path == "" {
+		return overrides, nil
+	}
+
+	JSONFile, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, errors.New("Could not read the per-node mysql credentials from specified file: " + path)
+	}
+
+	err = json.Unmarshal(JSONFile, &overrides)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the per-node mysql credentials in %s: %v", path, err)
+	}
+
+	for i, o := range overrides {
+		matchers := 0
+
+		for _, m := range []string{o.ServerUUID, o.Endpoint, o.Label} {
+			if m != "" {
+				matchers++
+			}
+		}
+
+		if matchers != 1 {
+			return nil, fmt.Errorf("Entry %d in %s must specify exactly one of server_uuid, endpoint or label", i, path)
+		}
+
+		if o.User == "" {
+			return nil, fmt.Errorf("Entry %d in %s has no user specified", i, path)
+		}
+	}
+
+	return overrides, nil
+}
@@ -0,0 +1,89 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package credentials
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadCredentialsDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		dirs    []string
+		want    Credentials
+		wantErr bool
+	}{
+		{
+			name:  "short names",
+			files: map[string]string{"user": "arbitrator\n", "password": "secret\n"},
+			want:  Credentials{User: "arbitrator", Password: "secret"},
+		},
+		{
+			name:  "the explicit names win",
+			files: map[string]string{"mysql-user": "arbitrator", "user": "other", "mysql-password": "secret", "password": "other"},
+			want:  Credentials{User: "arbitrator", Password: "secret"},
+		},
+		{
+			name:  "missing and empty secrets are skipped",
+			files: map[string]string{"mysql-password": "", "password": "secret"},
+			want:  Credentials{Password: "secret"},
+		},
+		{
+			name:    "unreadable secret",
+			files:   map[string]string{"user": "arbitrator"},
+			dirs:    []string{"mysql-password"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tt.files)
+
+			for _, d := range tt.dirs {
+				if err := os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			creds, err := readCredentialsDir(dir)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", creds)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if creds.User != tt.want.User || creds.Password != tt.want.Password {
+				t.Errorf("got %+v, want %+v", creds, tt.want)
+			}
+		})
+	}
+
+	if creds, err := readCredentialsDir(filepath.Join(t.TempDir(), "missing")); err != nil || creds.Password != "" {
+		t.Errorf("a missing directory should provide no credentials, got %v and %v", creds, err)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package credentials
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// the maximum depth of nested !include/!includedir directives we'll follow, this protects us from include loops
+const maxIncludeDepth = 10
+
+/*
+	ReadOptionFile parses a MySQL style option file (e.g. ~/.my.cnf) and returns the user and password found in the
+	requested groups. The groups are applied in the order given, so a value in a later group overrides the same value
+	in an earlier one -- just as the mysql client does with [client] followed by [mysql]. An example file being:
+
+[client]
+user=arbitrator
+password="my secret"
+
+[myarbitratord]
+password=my-other-secret
+*/
+func ReadOptionFile(path string, groups []string) (user string, password string, err error) {
+	values := make(map[string]map[string]string)
+
+	err = parseOptionFile(path, values, 0)
+
+	if err == nil {
+		for _, group := range groups {
+			if opts, ok := values[strings.ToLower(group)]; ok {
+				if val, ok := opts["user"]; ok {
+					user = val
+				}
+				if val, ok := opts["password"]; ok {
+					password = val
+				}
+			}
+		}
+	}
+
+	return user, password, err
+}
+
+func parseOptionFile(path string, values map[string]map[string]string, depth int) error {
+	if depth > maxIncludeDepth {
+		return errors.New("Too many nested includes in option file: " + path)
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	group := ""
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "!includedir") {
+			dir := strings.TrimSpace(strings.TrimPrefix(line, "!includedir"))
+			// mysql only reads the .cnf files within the directory, and the order isn't guaranteed, so let's sort them
+			matches, _ := filepath.Glob(filepath.Join(dir, "*.cnf"))
+			sort.Strings(matches)
+
+			for _, match := range matches {
+				if err = parseOptionFile(match, values, depth+1); err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		if strings.HasPrefix(line, "!include") {
+			if err = parseOptionFile(strings.TrimSpace(strings.TrimPrefix(line, "!include")), values, depth+1); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.IndexRune(line, ']')
+
+			if end == -1 {
+				return errors.New("Malformed group header in option file " + path + ": " + line)
+			}
+
+			group = strings.ToLower(strings.TrimSpace(line[1:end]))
+
+			continue
+		}
+
+		// options outside of any group are ignored by mysql too
+		if group == "" {
+			continue
+		}
+
+		key := line
+		val := ""
+		hasVal := false
+
+		if eq := strings.IndexRune(line, '='); eq != -1 {
+			key = line[:eq]
+			val = strings.TrimSpace(line[eq+1:])
+			hasVal = true
+		}
+
+		// dashes and underscores are interchangeable in option names
+		key = strings.ToLower(strings.Replace(strings.TrimSpace(key), "_", "-", -1))
+
+		// a bare "password" means that the client should prompt for it, which we can't do
+		if !hasVal {
+			continue
+		}
+
+		if values[group] == nil {
+			values[group] = make(map[string]string)
+		}
+
+		values[group][key] = unquoteOptionValue(val)
+	}
+
+	return scanner.Err()
+}
+
+// unquoteOptionValue handles quoted values, escape sequences and trailing comments the way the mysql client does
+func unquoteOptionValue(val string) string {
+	if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') {
+		for i := 1; i < len(val); i++ {
+			// an escaped quote doesn't end the value
+			if val[i] == '\\' {
+				i++
+			} else if val[i] == val[0] {
+				return unescapeOptionValue(val[1:i])
+			}
+		}
+	}
+
+	if hash := strings.Index(val, " #"); hash != -1 {
+		val = strings.TrimSpace(val[:hash])
+	}
+
+	return unescapeOptionValue(val)
+}
+
+// the escape sequences that mysql accepts in option values, a backslash followed by anything else is kept as is
+var optionEscapes = map[byte]byte{'b': '\b', 't': '\t', 'n': '\n', 'r': '\r', 's': ' ', '\\': '\\', '"': '"', '\'': '\''}
+
+func unescapeOptionValue(val string) string {
+	if strings.IndexByte(val, '\\') == -1 {
+		return val
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < len(val); i++ {
+		if val[i] == '\\' && i+1 < len(val) {
+			if esc, ok := optionEscapes[val[i+1]]; ok {
+				sb.WriteByte(esc)
+				i++
+				continue
+			}
+		}
+
+		sb.WriteByte(val[i])
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,170 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnquoteOptionValue(t *testing.T) {
+	tests := []struct {
+		val  string
+		want string
+	}{
+		{`secret`, `secret`},
+		{`"my secret"`, `my secret`},
+		{`'my secret'`, `my secret`},
+		{`"my secret" # a comment`, `my secret`},
+		{`secret # a comment`, `secret`},
+		{`sec#ret`, `sec#ret`},
+		{`"sec # ret"`, `sec # ret`},
+		{`"unterminated`, `"unterminated`},
+		{`"`, `"`},
+		{`""`, ``},
+		{`tab\there`, "tab\there"},
+		{`a\nb\rc\bd`, "a\nb\rc\bd"},
+		{`trailing\s`, `trailing `},
+		{`back\\slash`, `back\slash`},
+		{`"say \"hi\""`, `say "hi"`},
+		{`'it\'s'`, `it's`},
+		{`"\s # not a comment"`, `  # not a comment`},
+		{`C:\path`, `C:\path`},
+		{`ends\`, `ends\`},
+	}
+
+	for _, tt := range tests {
+		if got := unquoteOptionValue(tt.val); got != tt.want {
+			t.Errorf("unquoteOptionValue(%q) = %q, want %q", tt.val, got, tt.want)
+		}
+	}
+}
+
+// writeFiles creates the files, relative to dir, with their contents
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(strings.ReplaceAll(contents, "$DIR", dir)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadOptionFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		groups   []string
+		user     string
+		password string
+		wantErr  string
+	}{
+		{
+			name:     "later groups override earlier ones",
+			files:    map[string]string{"my.cnf": "[client]\nuser=arbitrator\npassword=\"my secret\"\n\n[myarbitratord]\npassword=my-other-secret\n"},
+			groups:   []string{"client", "myarbitratord"},
+			user:     "arbitrator",
+			password: "my-other-secret",
+		},
+		{
+			name:     "comments, bare options and options outside of a group are skipped",
+			files:    map[string]string{"my.cnf": "user=nobody\n# a comment\n; another\n[Client]\nuser = arbitrator # the account\npassword\n"},
+			groups:   []string{"client"},
+			user:     "arbitrator",
+			password: "",
+		},
+		{
+			name:     "escapes in the password",
+			files:    map[string]string{"my.cnf": "[client]\npassword=\"a\\\"b\\\\c\\sd\"\n"},
+			groups:   []string{"client"},
+			password: `a"b\c d`,
+		},
+		{
+			name: "include",
+			files: map[string]string{
+				"my.cnf":               "[client]\nuser=arbitrator\npassword=first\n!include $DIR/secrets/extra.cnf\n",
+				"secrets/extra.cnf":    "[client]\npassword=included\n",
+				"secrets/ignored.conf": "[client]\nuser=ignored\n",
+			},
+			groups:   []string{"client"},
+			user:     "arbitrator",
+			password: "included",
+		},
+		{
+			name: "includedir reads the .cnf files in order",
+			files: map[string]string{
+				"my.cnf":          "!includedir $DIR/conf.d\n[client]\nuser=arbitrator\n",
+				"conf.d/b.cnf":    "[client]\npassword=second\n",
+				"conf.d/a.cnf":    "[client]\npassword=first\n",
+				"conf.d/c.cnf.bk": "[client]\npassword=backup\n",
+			},
+			groups:   []string{"client"},
+			user:     "arbitrator",
+			password: "second",
+		},
+		{
+			name:    "missing include",
+			files:   map[string]string{"my.cnf": "[client]\n!include $DIR/missing.cnf\n"},
+			groups:  []string{"client"},
+			wantErr: "no such file",
+		},
+		{
+			name:    "include loop",
+			files:   map[string]string{"my.cnf": "[client]\npassword=loop\n!include $DIR/my.cnf\n"},
+			groups:  []string{"client"},
+			wantErr: "Too many nested includes",
+		},
+		{
+			name:    "malformed group header",
+			files:   map[string]string{"my.cnf": "[client\npassword=x\n"},
+			groups:  []string{"client"},
+			wantErr: "Malformed group header",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tt.files)
+
+			user, password, err := ReadOptionFile(filepath.Join(dir, "my.cnf"), tt.groups)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if user != tt.user || password != tt.password {
+				t.Errorf("got user %q and password %q, want %q and %q", user, password, tt.user, tt.password)
+			}
+		})
+	}
+}
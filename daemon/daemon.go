@@ -0,0 +1,103 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package daemon implements the systemd service notification protocol, see sd_notify(3), so that the arbitrator can be
+run with Type=notify and WatchdogSec= in its unit file. When not run by systemd everything here is a no-op.
+*/
+package daemon
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The states that we notify systemd of
+const (
+	// Ready tells systemd that the startup is complete
+	Ready = "READY=1"
+	// Stopping tells systemd that we've begun shutting down
+	Stopping = "STOPPING=1"
+	// Watchdog is the keepalive, which must be sent within WatchdogSec or systemd will consider us hung
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status is a free-form description of our current state, shown by "systemctl status"
+func Status(status string) string {
+	// each assignment is one line, so the status can't span lines
+	return "STATUS=" + strings.Join(strings.Fields(status), " ")
+}
+
+/*
+Notify sends the states to systemd, with a state being one of the constants or Status(). It returns false, with no
+error, when we weren't started by systemd with Type=notify (there's no $NOTIFY_SOCKET).
+*/
+func Notify(states ...string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+
+	if socketPath == "" {
+		return false, nil
+	}
+
+	// a leading @ means that it's in the abstract namespace, which Go denotes with a leading NUL byte
+	addr := &net.UnixAddr{Name: socketPath, Net: "unixgram"}
+
+	if strings.HasPrefix(socketPath, "@") {
+		addr.Name = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, addr)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+/*
+WatchdogInterval returns the WatchdogSec= of our unit, or 0 when the watchdog isn't enabled for this process.
+The keepalives should be sent at half of this interval, as sd_watchdog_enabled(3) recommends.
+*/
+func WatchdogInterval() (time.Duration, error) {
+	usecs := os.Getenv("WATCHDOG_USEC")
+
+	if usecs == "" {
+		return 0, nil
+	}
+
+	// the watchdog may be meant for another process, e.g. the one that started us
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+
+	usec, err := strconv.ParseInt(usecs, 10, 64)
+
+	if err != nil || usec <= 0 {
+		return 0, &strconv.NumError{Func: "WatchdogInterval", Num: usecs, Err: strconv.ErrSyntax}
+	}
+
+	return time.Duration(usec) * time.Microsecond, nil
+}
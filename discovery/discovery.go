@@ -0,0 +1,178 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package discovery finds the mysqld endpoints that can be used as seed nodes for monitoring a cluster: from a list given
+on the command-line or in a file, from a DNS SRV record, or from all of the A/AAAA records for a hostname.
+*/
+package discovery
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Endpoint is a mysqld that we can connect to
+type Endpoint struct {
+	Host string
+	Port string
+}
+
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.Host, e.Port)
+}
+
+// parseEndpoint handles "host", "host:port", "ipv6", and "[ipv6]:port"
+func parseEndpoint(entry string, defaultPort string) (Endpoint, error) {
+	if host, port, err := net.SplitHostPort(entry); err == nil {
+		if host == "" || port == "" {
+			return Endpoint{}, errors.New("Invalid seed node: " + entry)
+		}
+
+		return Endpoint{Host: host, Port: port}, nil
+	}
+
+	// a bare IPv6 address has colons, but no port
+	host := strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]")
+
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return Endpoint{}, errors.New("Invalid seed node: " + entry)
+	}
+
+	return Endpoint{Host: host, Port: defaultPort}, nil
+}
+
+// ParseList parses a comma separated list of seed nodes, e.g. "hanode1,hanode2:3307,[fd00::3]:3306"
+func ParseList(list string, defaultPort string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		endpoint, err := parseEndpoint(entry, defaultPort)
+
+		if err != nil {
+			return nil, err
+		}
+
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return endpoints, nil
+}
+
+/*
+ReadFile reads the seed nodes from a file with one host[:port] per line, where empty lines and lines starting with
+a # are ignored. For example:
+
+	# the members of the production cluster
+	hanode1:3306
+	hanode2:3306
+	hanode3
+*/
+func ReadFile(path string, defaultPort string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, errors.New("Could not read the seed nodes from specified file: " + path)
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+
+		if entry == "" || entry[0] == '#' {
+			continue
+		}
+
+		endpoint, err := parseEndpoint(entry, defaultPort)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return endpoints, scanner.Err()
+}
+
+// LookupSRV returns the endpoints in the DNS SRV record, e.g. "_mysql._tcp.cluster1.example.com", in the order that
+// they should be tried: by priority, and then randomized by weight
+func LookupSRV(name string) ([]Endpoint, error) {
+	_, records, err := net.LookupSRV("", "", name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]Endpoint, 0, len(records))
+
+	for _, srv := range records {
+		endpoints = append(endpoints, Endpoint{Host: strings.TrimSuffix(srv.Target, "."), Port: fmt.Sprintf("%d", srv.Port)})
+	}
+
+	return endpoints, nil
+}
+
+// ExpandHosts replaces each hostname with all of the addresses in its A/AAAA records, keeping any that can't be
+// resolved as they are so that the failure is seen when connecting to it
+func ExpandHosts(endpoints []Endpoint) []Endpoint {
+	var expanded []Endpoint
+
+	for _, e := range endpoints {
+		addrs, err := net.LookupHost(e.Host)
+
+		if err != nil || net.ParseIP(e.Host) != nil {
+			expanded = append(expanded, e)
+			continue
+		}
+
+		for _, addr := range addrs {
+			expanded = append(expanded, Endpoint{Host: addr, Port: e.Port})
+		}
+	}
+
+	return Dedupe(expanded)
+}
+
+// Dedupe removes any repeated endpoints, keeping the first of each
+func Dedupe(endpoints []Endpoint) []Endpoint {
+	seen := make(map[Endpoint]bool)
+	unique := endpoints[:0:0]
+
+	for _, e := range endpoints {
+		if !seen[e] {
+			seen[e] = true
+			unique = append(unique, e)
+		}
+	}
+
+	return unique
+}
@@ -0,0 +1,170 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/notify"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// The ejection policies for members that are persistently lagging
+const (
+	// ejectReadOnly enables super_read_only on the member, so that it no longer takes any writes
+	ejectReadOnly = "read-only"
+	// ejectStop has the member leave the group, so that it no longer throttles the group through flow control
+	ejectStop = "stop"
+)
+
+// the ejection settings, see the flags in main, where an empty policy disables it
+var (
+	ejectPolicy        = ""
+	ejectQueue  uint64 = 100000
+	ejectAfter         = 5 * time.Minute
+)
+
+/*
+ejectLagging applies the ejection policy to the member that has been lagging the longest, its applier queue having
+been over the -eject-queue threshold for at least -eject-after. Only one member is ejected per loop, and a member is
+never removed from the group if that could cost the group its quorum. The applier queue is checked again, using the
+GTID sets, right before the member is ejected.
+*/
+func ejectLagging(logger *slog.Logger, loopNum uint, seedNode group.Node, members []group.Node) {
+	if ejectPolicy == "" {
+		return
+	}
+
+	var oldest *memberLag
+
+	lagSeries.RLock()
+	for _, ml := range lagSeries.members {
+		if ml.LaggingSince != nil && time.Since(*ml.LaggingSince) >= ejectAfter && (oldest == nil || ml.LaggingSince.Before(*oldest.LaggingSince)) {
+			oldest = ml
+		}
+	}
+	lagSeries.RUnlock()
+
+	if oldest == nil {
+		return
+	}
+
+	var member *group.Node
+
+	for i := range members {
+		if members[i].ServerUuid == oldest.ServerUUID && members[i].MemberState == "ONLINE" {
+			member = &members[i]
+			break
+		}
+	}
+
+	if member == nil {
+		return
+	}
+
+	// a member leaving the group mustn't leave the rest without a majority of the current membership
+	if ejectPolicy == ejectStop {
+		if gerr := guardAction("Ejecting "+member.MySQLHost+":"+member.MySQLPort, members, *member); gerr != nil {
+			lagSeries.Lock()
+			blocked := oldest.ejectBlocked
+			oldest.ejectBlocked = true
+			lagSeries.Unlock()
+
+			if !blocked {
+				nodeLogger(logger, member).Warn("Not ejecting the lagging member, as the group could then lose its quorum", "online_members", seedNode.OnlineParticipants, "members", len(members), logging.KeyError, gerr)
+			}
+
+			return
+		}
+	}
+
+	err := member.Connect()
+	noteConnectResult(member, err)
+	defer member.Cleanup()
+
+	if err != nil {
+		nodeLogger(logger, member).Error("Could not connect to the lagging member to eject it", logging.KeyError, err)
+		return
+	}
+
+	if ejectPolicy == ejectReadOnly {
+		if readOnly, rerr := member.IsReadOnly(); rerr == nil && readOnly {
+			return
+		}
+
+		// in single-primary mode, making the primary read only would stop all writes to the cluster
+		primary, perr := member.IsPrimary()
+
+		if perr != nil || primary {
+			lagSeries.Lock()
+			blocked := oldest.ejectBlocked
+			oldest.ejectBlocked = true
+			lagSeries.Unlock()
+
+			if !blocked {
+				nodeLogger(logger, member).Warn("Not ejecting the lagging member, as it's the primary (or we couldn't tell) and the read-only policy would stop all writes", logging.KeyError, perr)
+			}
+
+			return
+		}
+	}
+
+	queue, err := member.ApplierQueueLength()
+
+	if err != nil || queue < ejectQueue {
+		nodeLogger(logger, member).Info("Not ejecting the lagging member, as its applier queue is no longer over the threshold", "applier_queue", queue, logging.KeyError, err)
+		return
+	}
+
+	decisionID := newDecisionID()
+	reason := fmt.Sprintf("The member's applier queue has been over %d transactions since %s, it's now %d", ejectQueue, oldest.LaggingSince.Format(time.RFC3339), queue)
+	if !allowAction(logger, actionEject, seedNode.GroupName, member, decisionID) {
+		return
+	}
+
+	nodeLogger(logger, member).Warn("Ejecting the persistently lagging member", logging.KeyDecisionID, decisionID, "policy", ejectPolicy, "applier_queue", queue, "lagging_since", *oldest.LaggingSince)
+
+	auditor.justify(decisionID, reason, newSnapshot(loopNum, seedNode, true, members))
+
+	if ejectPolicy == ejectStop {
+		err = member.StopGroupReplication()
+		events.Publish(actionEvent(notify.EventMemberEjected, member, decisionID, "Removed the persistently lagging member from the group: "+reason, err))
+	} else {
+		err = member.SetReadOnly(true)
+		events.Publish(actionEvent(notify.EventReadOnly, member, decisionID, "Enabled super_read_only on the persistently lagging member: "+reason, err))
+	}
+
+	if err != nil {
+		nodeLogger(logger, member).Error("Could not eject the lagging member", logging.KeyDecisionID, decisionID, logging.KeyError, err)
+		return
+	}
+
+	// so we don't act on it again, unless it stays lagging for another -eject-after
+	lagSeries.Lock()
+	if ml := lagSeries.members[member.ServerUuid]; ml != nil {
+		ml.LaggingSince = nil
+	}
+	lagSeries.Unlock()
+}
+
+// validEjectPolicy checks the -eject-lagging flag
+func validEjectPolicy(policy string) bool {
+	return policy == "" || policy == ejectReadOnly || policy == ejectStop
+}
@@ -0,0 +1,182 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+/*
+The decisions that don't need to touch any server are made here, so that they're the same whether they're being made
+by MonitorCluster for a real cluster or being simulated for a hypothetical one, see simulate.go
+*/
+
+// The actions that we can decide on for a member
+const (
+	decideNone         = "none"
+	decideReadOnly     = "read_only"
+	decideShutdown     = "shutdown"
+	decideForceMembers = "force_members"
+)
+
+// memberAction decides what to do with a member of a group that has a quorum, from its state and quorum as it sees them
+func memberAction(state string, quorum bool) (string, string) {
+	// If Group Replication has been stopped, then let's set super_read_only mode to protect consistency
+	// But not shut it down, as the DBA may need to perform some maintenance
+	if state == "OFFLINE" {
+		return decideReadOnly, "Group Replication is stopped on the node, protecting consistency with super_read_only"
+	}
+
+	// If this node sees itself in the ERROR state or doesn't think it has a quorum, then it should be safe to shut it down
+	if state == "ERROR" || !quorum {
+		return decideShutdown, fmt.Sprintf("The node is not a healthy member of the primary partition (member state: %s, quorum: %t)", state, quorum)
+	}
+
+	return decideNone, ""
+}
+
+// viewHasQuorum tells us if a member's view of the group has a quorum, which is when a majority of it is ONLINE
+func viewHasQuorum(view []group.Node) bool {
+	online := 0
+
+	for _, member := range view {
+		if member.MemberState == "ONLINE" {
+			online++
+		}
+	}
+
+	return online*2 > len(view)
+}
+
+/*
+forceCandidate returns the member of the partition that should become the new primary one once no partition has a
+quorum, from the reachability matrix, see reachabilityMatrix.candidate. When we couldn't ask any of the members for
+their view of the group, it falls back to the member in the view that sees the most online participants, with
+trxCount breaking any ties. It's false when there's no member at all to choose from.
+*/
+func forceCandidate(logger *slog.Logger, matrix *reachabilityMatrix, view []group.Node, trxCount func(node group.Node) uint64) (group.Node, bool) {
+	if candidate, ok := matrix.candidate(logger, trxCount); ok {
+		return candidate, true
+	}
+
+	if len(view) == 0 {
+		return group.Node{}, false
+	}
+
+	sorted := make([]group.Node, len(view))
+	copy(sorted, view)
+	sort.Stable(MembersByOnlineNodes(sorted))
+
+	logger.Debug("Member view sorted by number of online nodes", "view", sorted)
+
+	// now the last member is the one to use as it's coordinating with the most nodes, unless another one ties with it
+	best := len(sorted) - 1
+	bestTrxCount := trxCount(sorted[best])
+
+	for i := best - 1; i >= 0 && sorted[i].OnlineParticipants == sorted[best].OnlineParticipants; i-- {
+		if count := trxCount(sorted[i]); count > bestTrxCount {
+			best, bestTrxCount = i, count
+		}
+	}
+
+	return sorted[best], true
+}
+
+// forceObservation is what we observed of a member in the candidate's view, when deciding on the membership to force
+type forceObservation struct {
+	// Node has the member's state as it sees itself, when we reached it
+	Node    group.Node
+	Reached bool
+	// Seen is the member's state as the candidate sees it
+	Seen string
+	// Endpoint is the member's GCS endpoint, when it's ONLINE and we could get it
+	Endpoint    group.GCSEndpoint
+	EndpointErr error
+}
+
+// forceDecision is the membership to force to form a new primary partition, and what happens to the members left out
+type forceDecision struct {
+	Forced       []group.Node
+	Endpoints    []group.GCSEndpoint
+	ForceMembers string
+	// Losing are the members that we couldn't reach or that aren't ONLINE, as they see themselves or as the candidate
+	// sees them, which are fenced once the forced membership is ONLINE with a quorum
+	Losing []group.Node
+	// Unfenced is why each of the Losing members mustn't be fenced, nil when it can be
+	Unfenced []error
+	// Excluded are the ONLINE members that are left out as we couldn't get their GCS endpoint, they're not fenced
+	Excluded []forceObservation
+	// Blocked is why there's no valid membership to force, so the group remains blocked
+	Blocked error
+	// Refused is why the quorum guard won't let us force the membership
+	Refused error
+}
+
+// errNoForceMembers is when none of the members in the candidate's view can be part of the forced membership
+var errNoForceMembers = errors.New("No valid group membership to force")
+
+/*
+decideForce decides on the membership to force from the candidate's view of the group: the reachable members with a
+valid GCS endpoint that are ONLINE, both as they see themselves and as the candidate sees them, are forced. A member
+of another partition can still see itself as ONLINE, so it's the candidate's view that keeps it out. The members that
+we couldn't reach or that aren't ONLINE are fenced, as long as the quorum guard, with the given minimum of ONLINE
+members, allows it.
+*/
+func decideForce(observed []forceObservation, minOnline int) forceDecision {
+	var decision forceDecision
+
+	for _, o := range observed {
+		switch {
+		case !o.Reached || o.Node.MemberState != "ONLINE" || o.Seen != "ONLINE":
+			decision.Losing = append(decision.Losing, o.Node)
+		case o.EndpointErr != nil:
+			decision.Excluded = append(decision.Excluded, o)
+		default:
+			decision.Forced = append(decision.Forced, o.Node)
+			decision.Endpoints = append(decision.Endpoints, o.Endpoint)
+		}
+	}
+
+	decision.ForceMembers = group.ForceMembersValue(decision.Endpoints)
+
+	if decision.ForceMembers == "" {
+		decision.Blocked = errNoForceMembers
+		return decision
+	}
+
+	if err := group.CheckGCSEndpoints(decision.Endpoints); err != nil {
+		decision.Blocked = err
+		return decision
+	}
+
+	if err := guardMembership("Forcing the membership to "+decision.ForceMembers, decision.Forced, minOnline); err != nil {
+		decision.Refused = err
+		return decision
+	}
+
+	// the new primary partition has to be able to carry on without each of the fenced nodes
+	for _, loser := range decision.Losing {
+		decision.Unfenced = append(decision.Unfenced, guardMembership("Shutting down "+loser.MySQLHost+":"+loser.MySQLPort, decision.Forced, minOnline, loser))
+	}
+
+	return decision
+}
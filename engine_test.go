@@ -0,0 +1,360 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/mattlord/myarbitratord/replication/group"
+	"github.com/mattlord/myarbitratord/replication/group/grouptest"
+)
+
+func init() {
+	group.DriverName = grouptest.DriverName
+}
+
+// stubMember starts the stand-in for the member's mysqld, which has executed the GTID set and sees the group as view
+func stubMember(node group.Node, gtids string, view []group.Node) *grouptest.Member {
+	m := grouptest.Add(node.MySQLHost+":"+node.MySQLPort).
+		Returns(group.GR_NAME_QUERY, []driver.Value{"550fa9ee-a1f8-4b6d-9bfe-c03c12cd1c72"}).
+		Returns(group.GR_STATUS_QUERY, []driver.Value{node.ServerUuid, node.MemberState}).
+		Returns(group.GR_QUORUM_QUERY, []driver.Value{boolString(viewHasQuorum(view))}).
+		Returns(group.GR_GTID_QUERY, []driver.Value{gtids}).
+		Returns(group.GR_GCSADDR_QUERY, []driver.Value{node.MySQLHost + ":33061"})
+
+	var rows [][]driver.Value
+
+	for _, seen := range view {
+		rows = append(rows, []driver.Value{seen.ServerUuid, seen.MySQLHost, seen.MySQLPort, seen.MemberState})
+	}
+
+	return m.Returns(group.GR_MEMBERS_QUERY, rows...)
+}
+
+func boolString(b bool) string {
+	if b {
+		return "true"
+	}
+
+	return "false"
+}
+
+/*
+stubTiedSplit starts the stand-ins for a group of 4 split evenly in two, hanode1 and hanode2 against hanode3 and
+hanode4, with hanode4 having executed the most GTIDs, and returns the group as the seed node last saw it
+*/
+func stubTiedSplit() []group.Node {
+	all := []string{"hanode1", "hanode2", "hanode3", "hanode4"}
+	gtids := map[string]string{
+		"hanode1": "550fa9ee-a1f8-4b6d-9bfe-c03c12cd1c72:1-10",
+		"hanode2": "550fa9ee-a1f8-4b6d-9bfe-c03c12cd1c72:1-10",
+		"hanode3": "550fa9ee-a1f8-4b6d-9bfe-c03c12cd1c72:1-10",
+		"hanode4": "550fa9ee-a1f8-4b6d-9bfe-c03c12cd1c72:1-20",
+	}
+
+	for _, host := range all[:2] {
+		stubMember(testNode(host, "ONLINE", 0), gtids[host], testView(all, all[:2]...))
+	}
+
+	for _, host := range all[2:] {
+		stubMember(testNode(host, "ONLINE", 0), gtids[host], testView(all, all[2:]...))
+	}
+
+	return testView(all, all...)
+}
+
+func TestMemberAction(t *testing.T) {
+	tests := []struct {
+		state  string
+		quorum bool
+		want   string
+	}{
+		{"ONLINE", true, decideNone},
+		{"RECOVERING", true, decideNone},
+		{"OFFLINE", false, decideReadOnly},
+		{"ERROR", true, decideShutdown},
+		{"ONLINE", false, decideShutdown},
+	}
+
+	for _, tt := range tests {
+		if got, _ := memberAction(tt.state, tt.quorum); got != tt.want {
+			t.Errorf("memberAction(%s, %t) = %s, want %s", tt.state, tt.quorum, got, tt.want)
+		}
+	}
+}
+
+func TestForceCandidate(t *testing.T) {
+	all := []string{"a", "b", "c", "d", "e"}
+
+	tests := []struct {
+		name  string
+		view  []group.Node
+		views [][]group.Node
+		trx   map[string]uint64
+		want  string
+	}{
+		{
+			name:  "the largest partition wins",
+			view:  testView(all, all...),
+			views: [][]group.Node{testView(all, "a", "b"), testView(all, "a", "b"), testView(all, "c", "d", "e"), testView(all, "c", "d", "e"), testView(all, "c", "d", "e")},
+			trx:   map[string]uint64{"a": 100},
+			want:  "c",
+		},
+		{
+			name:  "a tie is broken by the most GTIDs",
+			view:  testView(all[:4], all[:4]...),
+			views: [][]group.Node{testView(all[:4], "a", "b"), testView(all[:4], "a", "b"), testView(all[:4], "c", "d"), testView(all[:4], "c", "d")},
+			trx:   map[string]uint64{"a": 10, "b": 10, "c": 10, "d": 20},
+			want:  "d",
+		},
+		{
+			name:  "only the members that we could ask can be chosen",
+			view:  testView(all[:3], all[:3]...),
+			views: [][]group.Node{nil, nil, testView(all[:3], "c")},
+			want:  "c",
+		},
+		{
+			name:  "without any views the member seeing the most online participants wins",
+			view:  []group.Node{testNode("a", "ONLINE", 1), testNode("b", "ONLINE", 2), testNode("c", "ONLINE", 2)},
+			views: [][]group.Node{nil, nil, nil},
+			trx:   map[string]uint64{"b": 20, "c": 10},
+			want:  "b",
+		},
+		{
+			name:  "no members",
+			views: [][]group.Node{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matrix := newReachabilityMatrix(tt.view, tt.views)
+			got, ok := forceCandidate(testLog, matrix, tt.view, func(node group.Node) uint64 { return tt.trx[node.MySQLHost] })
+
+			if ok != (tt.want != "") || got.MySQLHost != tt.want {
+				t.Errorf("forceCandidate() = %q, %t, want %q", got.MySQLHost, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecutedCount(t *testing.T) {
+	defer grouptest.Reset()
+
+	stubMember(testNode("hanode1", "ONLINE", 0), "550fa9ee-a1f8-4b6d-9bfe-c03c12cd1c72:1-1042", nil)
+
+	if count := executedCount(testNode("hanode1", "", 0)); count != 1042 {
+		t.Errorf("executedCount() = %d, want 1042", count)
+	}
+
+	// we can't tell for a member that's down
+	if count := executedCount(testNode("hanode2", "", 0)); count != 0 {
+		t.Errorf("executedCount() = %d for a member that's down, want 0", count)
+	}
+}
+
+func TestPickForceCandidateTie(t *testing.T) {
+	defer grouptest.Reset()
+
+	view := stubTiedSplit()
+
+	if candidate := pickForceCandidate(testLog, view); candidate.MySQLHost != "hanode4" {
+		t.Errorf("pickForceCandidate() = %s, want hanode4 as it has executed the most GTIDs", candidate.MySQLHost)
+	}
+}
+
+func TestDecideForce(t *testing.T) {
+	online := func(host string, gcs string) forceObservation {
+		endpoint, err := group.ParseGCSEndpoint(gcs)
+		return forceObservation{Node: testNode(host, "ONLINE", 0), Reached: true, Seen: "ONLINE", Endpoint: endpoint, EndpointErr: err}
+	}
+
+	unreachable := func(host string) forceObservation {
+		return forceObservation{Node: testNode(host, "UNREACHABLE", 0), Seen: "UNREACHABLE"}
+	}
+
+	tests := []struct {
+		name      string
+		observed  []forceObservation
+		minOnline int
+		want      string
+		losing    int
+		excluded  int
+		blocked   bool
+		refused   bool
+	}{
+		{
+			name:     "the reachable ONLINE members are forced and the others fenced",
+			observed: []forceObservation{online("a", "a:33061"), online("b", "b:33061"), unreachable("c")},
+			want:     "a:33061,b:33061",
+			losing:   1,
+		},
+		{
+			name:     "a member that's not ONLINE is fenced",
+			observed: []forceObservation{online("a", "a:33061"), {Node: testNode("b", "ERROR", 0), Reached: true, Seen: "UNREACHABLE"}},
+			want:     "a:33061",
+			losing:   1,
+		},
+		{
+			name:     "a member of another partition is fenced, even though it sees itself as ONLINE",
+			observed: []forceObservation{online("a", "a:33061"), online("b", "b:33061"), {Node: testNode("c", "ONLINE", 0), Reached: true, Seen: "UNREACHABLE"}},
+			want:     "a:33061,b:33061",
+			losing:   1,
+		},
+		{
+			name:     "a member without a GCS endpoint is left out but not fenced",
+			observed: []forceObservation{online("a", "a:33061"), {Node: testNode("b", "ONLINE", 0), Reached: true, Seen: "ONLINE", EndpointErr: errors.New("no endpoint")}},
+			want:     "a:33061",
+			excluded: 1,
+		},
+		{
+			name:     "nothing to force",
+			observed: []forceObservation{unreachable("a"), unreachable("b")},
+			losing:   2,
+			blocked:  true,
+		},
+		{
+			name:     "duplicate GCS endpoints",
+			observed: []forceObservation{online("a", "x:33061"), online("b", "X:33061")},
+			want:     "x:33061,X:33061",
+			blocked:  true,
+		},
+		{
+			name:      "too few ONLINE members",
+			observed:  []forceObservation{online("a", "a:33061"), unreachable("b"), unreachable("c")},
+			minOnline: 2,
+			want:      "a:33061",
+			losing:    2,
+			refused:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			minOnline := tt.minOnline
+
+			if minOnline == 0 {
+				minOnline = 1
+			}
+
+			decision := decideForce(tt.observed, minOnline)
+
+			if decision.ForceMembers != tt.want {
+				t.Errorf("ForceMembers = %q, want %q", decision.ForceMembers, tt.want)
+			}
+
+			if len(decision.Losing) != tt.losing || len(decision.Excluded) != tt.excluded {
+				t.Errorf("%d losing and %d excluded members, want %d and %d", len(decision.Losing), len(decision.Excluded), tt.losing, tt.excluded)
+			}
+
+			if (decision.Blocked != nil) != tt.blocked || (decision.Refused != nil) != tt.refused {
+				t.Errorf("Blocked = %v and Refused = %v, want blocked %t and refused %t", decision.Blocked, decision.Refused, tt.blocked, tt.refused)
+			}
+
+			if decision.Blocked == nil && decision.Refused == nil {
+				if len(decision.Unfenced) != len(decision.Losing) {
+					t.Fatalf("%d fencing decisions for %d losing members", len(decision.Unfenced), len(decision.Losing))
+				}
+
+				for i, err := range decision.Unfenced {
+					if err != nil {
+						t.Errorf("%s can't be fenced: %v", decision.Losing[i].MySQLHost, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	no := false
+	// d listens on another port, so that its GCS address defaults to another port too
+	all := []string{"a:3306", "b:3306", "c:3306", "d:3307"}
+	sees := func(hosts ...string) map[string]string {
+		view := make(map[string]string)
+
+		for _, h := range all {
+			view[h] = "UNREACHABLE"
+		}
+
+		for _, h := range hosts {
+			view[h] = "ONLINE"
+		}
+
+		return view
+	}
+
+	tests := []struct {
+		name     string
+		cluster  simCluster
+		decision string
+		force    string
+		actions  int
+	}{
+		{
+			name:     "a healthy group",
+			cluster:  simCluster{Members: []simMember{{Host: "a"}, {Host: "b"}, {Host: "c"}}},
+			decision: simNoAction,
+		},
+		{
+			name:     "a member that has stopped Group Replication",
+			cluster:  simCluster{Members: []simMember{{Host: "a"}, {Host: "b"}, {Host: "c", State: "OFFLINE"}}},
+			decision: simActOnMembers,
+			actions:  1,
+		},
+		{
+			name:     "no member can be reached",
+			cluster:  simCluster{Members: []simMember{{Host: "a", Reachable: &no}, {Host: "b", Reachable: &no}}},
+			decision: simNoSeed,
+		},
+		{
+			name: "another partition has a quorum",
+			cluster: simCluster{Seed: "a:3306", Members: []simMember{
+				{Host: "a", Sees: sees("a:3306")}, {Host: "b", Sees: sees("b:3306", "c:3306", "d:3307")}, {Host: "c", Sees: sees("b:3306", "c:3306", "d:3307")}, {Host: "d", Port: "3307", Sees: sees("b:3306", "c:3306", "d:3307")},
+			}},
+			decision: simNewSeed,
+		},
+		{
+			name: "an even split is forced to the partition with the most GTIDs",
+			cluster: simCluster{Seed: "a:3306", Members: []simMember{
+				{Host: "a", Sees: sees("a:3306", "b:3306"), GTIDExecuted: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-10"},
+				{Host: "b", Sees: sees("a:3306", "b:3306"), GTIDExecuted: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-10"},
+				{Host: "c", Sees: sees("c:3306", "d:3307"), GTIDExecuted: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-20"},
+				{Host: "d", Port: "3307", Sees: sees("c:3306", "d:3307")},
+			}},
+			decision: simForce,
+			force:    "c:33061,d:33071",
+			actions:  3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := simulate(tt.cluster)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Decision != tt.decision || result.ForceMembers != tt.force || len(result.Actions) != tt.actions {
+				t.Errorf("decision %s forcing %q with %d actions, want %s forcing %q with %d actions: %v", result.Decision, result.ForceMembers, len(result.Actions), tt.decision, tt.force, tt.actions, result.Reasons)
+			}
+		})
+	}
+}
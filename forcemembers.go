@@ -0,0 +1,499 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/notify"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// the forced membership confirmation settings, see the flags in main
+var (
+	// forceConfirmDelay is how long to wait before probing the members again to confirm the forced membership, 0 disables it
+	forceConfirmDelay time.Duration
+	// forceApproval requires an operator to approve each forced membership via the "/force/approve" HTTP API call
+	forceApproval bool
+	// forceVerifyTimeout is how long the forced members have to be ONLINE with a quorum before we give up on them
+	forceVerifyTimeout = 30 * time.Second
+)
+
+// recoveryFailedState is our state once a forced membership didn't unblock the group
+const recoveryFailedState = "FAILED_RECOVERY"
+
+// failedRecovery is the forced membership that didn't unblock the group, presented as JSON via the "/stats" HTTP API call
+type failedRecovery struct {
+	State      string    `json:"State"`
+	DecisionID string    `json:"Decision ID"`
+	Cluster    string    `json:"Cluster"`
+	Since      time.Time `json:"Since"`
+	Reason     string    `json:"Reason"`
+	// so that we only log once that we're not handling the partition
+	logged bool
+}
+
+// findPrimaryPartition connects to each member in the view, returning the first one that has a quorum
+func findPrimaryPartition(view []group.Node) (group.Node, bool) {
+	for i := 0; i < len(view); i++ {
+		// each member can take up to the mysql timeouts, so we keep the heartbeat going
+		health.heartbeat()
+
+		err := view[i].Connect()
+		noteConnectResult(&view[i], err)
+		defer view[i].Cleanup()
+
+		quorum := false
+
+		if err == nil {
+			quorum, err = view[i].HasQuorum()
+			// let's make sure that the OnlineParticipants is up to date
+			_, err = view[i].GetMembers()
+		}
+
+		if err == nil && quorum {
+			return view[i], true
+		}
+
+		view[i].Cleanup()
+	}
+
+	return group.Node{}, false
+}
+
+// pickForceCandidate returns the member of the partition that should become the new primary one, see forceCandidate
+func pickForceCandidate(logger *slog.Logger, view []group.Node) group.Node {
+	candidate, _ := forceCandidate(logger, collectReachability(logger, view), view, executedCount)
+
+	return candidate
+}
+
+// forceProposal is a forced membership awaiting an operator's approval, presented as JSON via the "/force" HTTP API call
+type forceProposal struct {
+	DecisionID   string     `json:"Decision ID"`
+	Cluster      string     `json:"Cluster"`
+	Seed         string     `json:"Seed Node"`
+	ForceMembers string     `json:"Force Members"`
+	Losing       []string   `json:"Losing Members"`
+	Proposed     time.Time  `json:"Proposed"`
+	ApprovedAt   *time.Time `json:"Approved At,omitempty"`
+	ApprovedBy   string     `json:"Approved By,omitempty"`
+}
+
+// the forced membership that's awaiting approval, if any, which we keep proposing on each loop until it's approved
+var pendingForce = struct {
+	sync.Mutex
+	proposal *forceProposal
+}{}
+
+/*
+partitionDecisionID returns the decision ID for handling a partition, which is the pending proposal's while there is
+one, or the failed recovery's while we're in the FAILED_RECOVERY state, and if it's such an ongoing decision
+*/
+func partitionDecisionID() (string, bool) {
+	pendingForce.Lock()
+	defer pendingForce.Unlock()
+
+	if pendingForce.proposal != nil {
+		return pendingForce.proposal.DecisionID, true
+	}
+
+	mystats.RLock()
+	defer mystats.RUnlock()
+
+	if mystats.Recovery != nil {
+		return mystats.Recovery.DecisionID, true
+	}
+
+	return newDecisionID(), false
+}
+
+// abandonForce forgets about the forced membership that was awaiting approval, e.g. as the group has a quorum again
+func abandonForce(logger *slog.Logger, reason string) {
+	pendingForce.Lock()
+	proposal := pendingForce.proposal
+	pendingForce.proposal = nil
+	pendingForce.Unlock()
+
+	if proposal == nil {
+		return
+	}
+
+	logger.Warn("Abandoning the forced membership that was awaiting approval", logging.KeyDecisionID, proposal.DecisionID, "reason", reason)
+	events.Publish(notify.Event{Type: notify.EventForceAborted, Severity: notify.SeverityWarning, Cluster: proposal.Cluster, Node: proposal.Seed, DecisionID: proposal.DecisionID, Message: "Abandoned the forced membership that was awaiting approval: " + reason})
+}
+
+/*
+confirmForce is the second phase of forcing the membership, it tells us if we should go ahead and force it on the seed
+node. When -force-approval is used, the forced membership is first proposed and we wait, over as many loops as it
+takes, for an operator to approve it. Then after -force-confirm-delay we probe all of the members again, to confirm
+that the partition still has no quorum, that the same partition still wins, and that the losing members are still
+unreachable or have no quorum. It also returns a note about the approval for the audit log.
+*/
+func confirmForce(ctx context.Context, logger *slog.Logger, decisionID string, view []group.Node, seedNode group.Node, forceMemberString string, forced []group.Node, members []group.Node) (string, bool) {
+	losing := []group.Node{}
+	losingNames := []string{}
+
+	for _, member := range members {
+		if !containsNode(forced, member) {
+			losing = append(losing, member)
+			losingNames = append(losingNames, member.MySQLHost+":"+member.MySQLPort)
+		}
+	}
+
+	note := ""
+
+	if forceApproval {
+		pendingForce.Lock()
+		proposal := pendingForce.proposal
+		pendingForce.Unlock()
+
+		// a different forced membership needs its own approval
+		if proposal != nil && proposal.ForceMembers != forceMemberString {
+			abandonForce(logger, "the membership to force is now "+forceMemberString)
+			proposal = nil
+			decisionID = newDecisionID()
+		}
+
+		if proposal == nil {
+			pendingForce.Lock()
+			pendingForce.proposal = &forceProposal{DecisionID: decisionID, Cluster: seedNode.GroupName, Seed: seedNode.MySQLHost + ":" + seedNode.MySQLPort,
+				ForceMembers: forceMemberString, Losing: losingNames, Proposed: time.Now()}
+			pendingForce.Unlock()
+
+			nodeLogger(logger, &seedNode).Warn("Forcing the membership is awaiting approval", logging.KeyDecisionID, decisionID, "force_members", forceMemberString, "losing_members", losingNames)
+
+			ev := nodeEvent(notify.EventForceApproval, notify.SeverityCritical, &seedNode, decisionID, "Forcing the membership is awaiting approval, via: curl -X POST 'http://<arbitrator>/force/approve?decision="+decisionID+"'")
+			ev.Details["force_members"] = forceMemberString
+			ev.Details["losing_members"] = strings.Join(losingNames, ",")
+			events.Publish(ev)
+
+			return "", false
+		}
+
+		pendingForce.Lock()
+		approvedAt, approvedBy := proposal.ApprovedAt, proposal.ApprovedBy
+		pendingForce.Unlock()
+
+		if approvedAt == nil {
+			logger.Debug("Still awaiting approval to force the membership", "force_members", forceMemberString)
+			return "", false
+		}
+
+		note = fmt.Sprintf(", approved by %s at %s", approvedBy, approvedAt.Format(time.RFC3339))
+	}
+
+	if forceConfirmDelay > 0 {
+		logger.Info("Waiting before confirming the forced membership", "delay", forceConfirmDelay, "force_members", forceMemberString)
+
+		// we keep the heartbeat going, so that a long delay doesn't look like we're stuck
+		for waited := time.Duration(0); waited < forceConfirmDelay && ctx.Err() == nil; waited += loopInterval {
+			health.heartbeat()
+			sleepContext(ctx, minDuration(loopInterval, forceConfirmDelay-waited))
+		}
+
+		if ctx.Err() != nil {
+			logger.Warn("Not forcing the membership as we're shutting down")
+			return "", false
+		}
+
+		if err := reprobeForce(view, forced, losing); err != nil {
+			nodeLogger(logger, &seedNode).Warn("Not forcing the membership, as it could not be confirmed", "force_members", forceMemberString, logging.KeyError, err)
+			events.Publish(nodeEvent(notify.EventForceAborted, notify.SeverityWarning, &seedNode, decisionID, "Not forcing the membership, as it could not be confirmed: "+err.Error()))
+
+			// an approval was for what we saw then, so it has to be proposed and approved again
+			pendingForce.Lock()
+			pendingForce.proposal = nil
+			pendingForce.Unlock()
+
+			return "", false
+		}
+
+		note += fmt.Sprintf(", confirmed after %s", forceConfirmDelay)
+	}
+
+	pendingForce.Lock()
+	pendingForce.proposal = nil
+	pendingForce.Unlock()
+
+	return note, true
+}
+
+// reprobeForce probes the members again, returning an error explaining why the forced membership is no longer right
+func reprobeForce(view []group.Node, forced []group.Node, losing []group.Node) error {
+	probe := make([]group.Node, len(view))
+	copy(probe, view)
+
+	// so that an unreachable member can't win with the participants it saw before
+	for i := range probe {
+		probe[i].OnlineParticipants = 0
+	}
+
+	if primary, ok := findPrimaryPartition(probe); ok {
+		return fmt.Errorf("the partition of %s:%s has a quorum again", primary.MySQLHost, primary.MySQLPort)
+	}
+
+	candidate := pickForceCandidate(Log, probe)
+
+	if !containsNode(forced, candidate) {
+		return fmt.Errorf("the partition of %s:%s is now the one to force", candidate.MySQLHost, candidate.MySQLPort)
+	}
+
+	err := candidate.Connect()
+	noteConnectResult(&candidate, err)
+	defer candidate.Cleanup()
+
+	if err != nil {
+		return err
+	}
+
+	current, err := candidate.GetMembers()
+
+	if err != nil {
+		return err
+	}
+
+	online := 0
+
+	for _, member := range current {
+		if member.MemberState == "ONLINE" {
+			if !containsNode(forced, member) {
+				return fmt.Errorf("%s:%s has joined the partition", member.MySQLHost, member.MySQLPort)
+			}
+
+			online++
+		}
+	}
+
+	if online != len(forced) {
+		return fmt.Errorf("the partition now has %d ONLINE members rather than %d", online, len(forced))
+	}
+
+	for _, member := range losing {
+		if err := member.Connect(); err != nil {
+			continue
+		}
+
+		quorum, err := member.HasQuorum()
+		member.Cleanup()
+
+		if err == nil && quorum {
+			return fmt.Errorf("%s:%s is reachable and has a quorum", member.MySQLHost, member.MySQLPort)
+		}
+	}
+
+	return nil
+}
+
+// executedCount returns how many GTIDs the node has executed, 0 when we can't tell
+func executedCount(node group.Node) uint64 {
+	count := uint64(0)
+	health.heartbeat()
+
+	if err := node.Connect(); err == nil {
+		count, _ = node.TransactionsExecutedCount()
+	}
+
+	node.Cleanup()
+
+	return count
+}
+
+// containsNode tells us if the node is one of the nodes
+func containsNode(nodes []group.Node, node group.Node) bool {
+	for _, n := range nodes {
+		if sameNode(n, node) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func minDuration(a time.Duration, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// This will serve the forced membership that's awaiting approval via a simple RESTful API
+func forceHandler(httpW http.ResponseWriter, httpR *http.Request) {
+	Log.Debug("Handling HTTP request for force")
+
+	pendingForce.Lock()
+	forceJSON, err := json.MarshalIndent(pendingForce.proposal, "", "    ")
+	pending := pendingForce.proposal != nil
+	pendingForce.Unlock()
+
+	if !pending {
+		http.Error(httpW, "No forced membership is awaiting approval", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		Log.Error("Error handling HTTP request for force", logging.KeyError, err)
+	}
+
+	httpW.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(httpW, "%s", forceJSON)
+}
+
+// This will approve the forced membership with the ?decision=<decision ID> via a simple RESTful API
+func forceApproveHandler(httpW http.ResponseWriter, httpR *http.Request) {
+	if httpR.Method != http.MethodPost {
+		httpW.Header().Set("Allow", http.MethodPost)
+		http.Error(httpW, "A forced membership can only be approved with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	decisionID := httpR.URL.Query().Get("decision")
+	Log.Info("Handling HTTP request to approve the forced membership", logging.KeyDecisionID, decisionID, "remote_addr", httpR.RemoteAddr)
+
+	pendingForce.Lock()
+	proposal := pendingForce.proposal
+
+	// the decision ID makes sure that what's approved is the forced membership that the operator looked at
+	if proposal == nil || decisionID == "" || proposal.DecisionID != decisionID {
+		pendingForce.Unlock()
+		http.Error(httpW, "No forced membership with the decision ID '"+decisionID+"' is awaiting approval", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	proposal.ApprovedAt = &now
+	proposal.ApprovedBy = httpR.RemoteAddr
+	approved := *proposal
+	pendingForce.Unlock()
+
+	Log.Warn("The forced membership has been approved", logging.KeyDecisionID, decisionID, "force_members", approved.ForceMembers, "approved_by", approved.ApprovedBy)
+
+	forceJSON, err := json.MarshalIndent(&approved, "", "    ")
+
+	if err != nil {
+		Log.Error("Error handling HTTP request to approve the forced membership", logging.KeyError, err)
+	}
+
+	httpW.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(httpW, "%s", forceJSON)
+}
+
+// verifyForce waits for each of the forced members to report itself ONLINE with a quorum, up to -force-verify-timeout
+func verifyForce(ctx context.Context, logger *slog.Logger, forced []group.Node) error {
+	deadline := time.Now().Add(forceVerifyTimeout)
+
+	for {
+		err := checkForced(forced)
+
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the forced membership didn't recover the group within %s: %v", forceVerifyTimeout, err)
+		}
+
+		logger.Debug("Waiting for the forced members to be ONLINE with a quorum", logging.KeyError, err)
+
+		// we keep the heartbeat going, so that waiting on the group doesn't look like we're stuck
+		health.heartbeat()
+		sleepContext(ctx, time.Second)
+	}
+}
+
+// checkForced returns an error for the first forced member that isn't ONLINE with a quorum, as far as it's concerned
+func checkForced(forced []group.Node) error {
+	for _, member := range forced {
+		err := member.Connect()
+		noteConnectResult(&member, err)
+
+		if err != nil {
+			return fmt.Errorf("%s:%s: %v", member.MySQLHost, member.MySQLPort, err)
+		}
+
+		quorum, err := member.HasQuorum()
+		member.Cleanup()
+
+		if err != nil {
+			return fmt.Errorf("%s:%s: %v", member.MySQLHost, member.MySQLPort, err)
+		}
+
+		if member.MemberState != "ONLINE" {
+			return fmt.Errorf("%s:%s is %s", member.MySQLHost, member.MySQLPort, member.MemberState)
+		}
+
+		if !quorum {
+			return fmt.Errorf("%s:%s has no quorum", member.MySQLHost, member.MySQLPort)
+		}
+	}
+
+	return nil
+}
+
+// failRecovery puts us in the FAILED_RECOVERY state, where we no longer handle the partition until the group has a quorum
+func failRecovery(logger *slog.Logger, seedNode *group.Node, decisionID string, reason error) {
+	mystats.Lock()
+	mystats.Recovery = &failedRecovery{State: recoveryFailedState, DecisionID: decisionID, Cluster: seedNode.GroupName, Since: time.Now(), Reason: reason.Error()}
+	mystats.Unlock()
+
+	nodeLogger(logger, seedNode).Error("The forced membership didn't recover the group, not fencing the other nodes and leaving the group for a human to recover", "state", recoveryFailedState, logging.KeyError, reason)
+
+	ev := nodeEvent(notify.EventRecoveryFailed, notify.SeverityCritical, seedNode, decisionID, "The forced membership didn't recover the group, it needs a human to recover it: "+reason.Error())
+	ev.Details["state"] = recoveryFailedState
+	events.Publish(ev)
+}
+
+// recoveryFailed tells us if we're in the FAILED_RECOVERY state, noting that we're not handling the partition
+func recoveryFailed(logger *slog.Logger) bool {
+	mystats.Lock()
+	defer mystats.Unlock()
+
+	if mystats.Recovery == nil {
+		return false
+	}
+
+	if !mystats.Recovery.logged {
+		mystats.Recovery.logged = true
+		logger.Warn("Not handling the partition, as the last forced membership failed to recover the group", "state", recoveryFailedState, "since", mystats.Recovery.Since)
+	}
+
+	return true
+}
+
+// clearFailedRecovery leaves the FAILED_RECOVERY state, as the group has a quorum again
+func clearFailedRecovery(logger *slog.Logger, reason string) {
+	mystats.Lock()
+	recovery := mystats.Recovery
+	mystats.Recovery = nil
+	mystats.Unlock()
+
+	if recovery == nil {
+		return
+	}
+
+	logger.Warn("Leaving the FAILED_RECOVERY state", logging.KeyDecisionID, recovery.DecisionID, "reason", reason)
+	events.Publish(notify.Event{Type: notify.EventRecoveryFailed, Severity: notify.SeverityInfo, Cluster: recovery.Cluster, DecisionID: recovery.DecisionID, Message: "The group has recovered, " + reason, Details: map[string]interface{}{"state": "resolved"}, Resolved: true})
+}
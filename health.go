@@ -0,0 +1,157 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// loopInterval is how long MonitorCluster sleeps between each check of the cluster
+const loopInterval = 2 * time.Second
+
+// healthMaxIntervals is how many loop intervals can pass without a completed loop before we're considered unhealthy
+var healthMaxIntervals = 20
+
+// healthState is what the "/healthz" and "/readyz" HTTP API calls report on
+type healthState struct {
+	sync.RWMutex
+	// when MonitorCluster last completed a loop, and started the next one
+	lastLoop time.Time
+	// we're ready once we have a valid seed node and membership view
+	ready    bool
+	reason   string
+	seed     string
+	viewSize int
+}
+
+var health = healthState{lastLoop: time.Now(), reason: "The cluster has not been checked yet"}
+
+// heartbeat notes that the monitoring loop is still making progress
+func (h *healthState) heartbeat() {
+	h.Lock()
+	h.lastLoop = time.Now()
+	h.Unlock()
+}
+
+// setReady notes that we have a valid seed node and membership view
+func (h *healthState) setReady(seed *group.Node, viewSize int, quorum bool) {
+	h.Lock()
+	h.ready = viewSize > 0
+	h.reason = ""
+	if !h.ready {
+		h.reason = "The membership view is empty"
+	}
+	h.seed = seed.MySQLHost + ":" + seed.MySQLPort
+	h.viewSize = viewSize
+	h.Unlock()
+
+	quorumStatus := "has quorum"
+	if !quorum {
+		quorumStatus = "NO QUORUM"
+	}
+
+	notifyStatus(fmt.Sprintf("Monitoring cluster %s via seed node %s:%s: %d members, %d online, %s", seed.GroupName, seed.MySQLHost, seed.MySQLPort, viewSize, seed.OnlineParticipants, quorumStatus))
+}
+
+// setNotReady notes why we can't currently monitor the cluster
+func (h *healthState) setNotReady(reason string) {
+	h.Lock()
+	h.ready = false
+	h.reason = reason
+	h.seed = ""
+	h.viewSize = 0
+	h.Unlock()
+
+	notifyStatus(reason)
+}
+
+// alive tells us if the monitoring loop is still making progress, along with how long it's been since the last loop
+func (h *healthState) alive() (bool, time.Duration, time.Duration) {
+	h.RLock()
+	since := time.Since(h.lastLoop)
+	h.RUnlock()
+
+	limit := time.Duration(healthMaxIntervals) * loopInterval
+
+	return since <= limit, since, limit
+}
+
+// healthzHandler tells a supervisor if the arbitrator is alive, meaning that the monitoring loop isn't stuck
+func healthzHandler(httpW http.ResponseWriter, httpR *http.Request) {
+	Log.Debug("Handling HTTP request for healthz")
+
+	alive, since, limit := health.alive()
+	status := struct {
+		Status   string `json:"Status"`
+		LastLoop string `json:"Last Loop Completed"`
+		Reason   string `json:"Reason,omitempty"`
+	}{"OK", since.Round(time.Millisecond).String() + " ago", ""}
+	code := http.StatusOK
+
+	if !alive {
+		status.Status = "UNHEALTHY"
+		status.Reason = fmt.Sprintf("The monitoring loop has not completed within %v", limit)
+		code = http.StatusServiceUnavailable
+	}
+
+	writeHealth(httpW, code, status)
+}
+
+// readyzHandler tells a load balancer or supervisor if the arbitrator is actually monitoring a cluster
+func readyzHandler(httpW http.ResponseWriter, httpR *http.Request) {
+	Log.Debug("Handling HTTP request for readyz")
+
+	health.RLock()
+	status := struct {
+		Status   string `json:"Status"`
+		Seed     string `json:"Seed Node,omitempty"`
+		ViewSize int    `json:"Membership View Size"`
+		Reason   string `json:"Reason,omitempty"`
+	}{"READY", health.seed, health.viewSize, health.reason}
+	ready := health.ready
+	health.RUnlock()
+
+	code := http.StatusOK
+
+	if !ready {
+		status.Status = "NOT READY"
+		code = http.StatusServiceUnavailable
+	}
+
+	writeHealth(httpW, code, status)
+}
+
+func writeHealth(httpW http.ResponseWriter, code int, status interface{}) {
+	statusJSON, err := json.MarshalIndent(status, "", "    ")
+
+	if err != nil {
+		Log.Error("Error handling HTTP request for health", logging.KeyError, err)
+	}
+
+	httpW.Header().Set("Content-Type", "application/json")
+	httpW.Header().Set("Cache-Control", "no-store")
+	httpW.WriteHeader(code)
+
+	fmt.Fprintf(httpW, "%s\n", statusJSON)
+}
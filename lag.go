@@ -0,0 +1,221 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/notify"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// The lag levels, based on the size of a member's queue of transactions to certify and apply
+const (
+	lagOK       = "OK"
+	lagWarning  = "WARNING"
+	lagCritical = "CRITICAL"
+)
+
+// the lag settings, see the flags in main
+var (
+	// lagHistory is how many samples we keep for each member, the default being 5 minutes worth
+	lagHistory              = 150
+	lagWarningQueue  uint64 = 1000
+	lagCriticalQueue uint64 = 10000
+)
+
+// memberLag is the recent replication stats for one member, presented as JSON via the "/lag" HTTP API call
+type memberLag struct {
+	Endpoint   string `json:"Endpoint"`
+	ServerUUID string `json:"Server UUID"`
+	Label      string `json:"Label,omitempty"`
+	Level      string `json:"Lag Level"`
+	// LaggingSince is when the member's applier queue last went over the -eject-queue threshold
+	LaggingSince *time.Time          `json:"Lagging Since,omitempty"`
+	Samples      []group.MemberStats `json:"Samples"`
+	// so that we only log once that the member can't be ejected without costing the group quorum
+	ejectBlocked bool
+}
+
+var lagSeries = struct {
+	sync.RWMutex
+	members map[string]*memberLag
+}{members: make(map[string]*memberLag)}
+
+// lagLevel classifies the queue length against the thresholds, where a threshold of 0 is disabled
+func lagLevel(queue uint64) string {
+	if lagCriticalQueue > 0 && queue >= lagCriticalQueue {
+		return lagCritical
+	}
+
+	if lagWarningQueue > 0 && queue >= lagWarningQueue {
+		return lagWarning
+	}
+
+	return lagOK
+}
+
+// collectLag samples the replication stats of each member that's applying transactions
+func collectLag(logger *slog.Logger, members []group.Node) {
+	current := make(map[string]bool)
+
+	for _, member := range members {
+		if member.MemberState != "ONLINE" && member.MemberState != "RECOVERING" {
+			continue
+		}
+
+		current[member.ServerUuid] = true
+		// each member can take up to the mysql timeouts, so we keep the heartbeat going
+		health.heartbeat()
+
+		err := member.Connect()
+		noteConnectResult(&member, err)
+
+		if err == nil {
+			var stats group.MemberStats
+
+			if stats, err = member.GetMemberStats(); err == nil {
+				recordLag(logger, &member, stats)
+			}
+		}
+
+		if err != nil {
+			nodeLogger(logger, &member).Debug("Could not get the member's replication stats", logging.KeyError, err)
+		}
+
+		member.Cleanup()
+	}
+
+	// let's forget about the members that have left the group
+	lagSeries.Lock()
+	for uuid := range lagSeries.members {
+		if !current[uuid] {
+			delete(lagSeries.members, uuid)
+		}
+	}
+	lagSeries.Unlock()
+}
+
+// recordLag adds the sample to the member's time series, and tells everyone when it crosses a threshold
+func recordLag(logger *slog.Logger, member *group.Node, stats group.MemberStats) {
+	lagSeries.Lock()
+
+	ml := lagSeries.members[member.ServerUuid]
+
+	if ml == nil {
+		ml = &memberLag{ServerUUID: member.ServerUuid, Level: lagOK}
+		lagSeries.members[member.ServerUuid] = ml
+	}
+
+	ml.Endpoint = member.MySQLHost + ":" + member.MySQLPort
+	ml.Label = member.Label
+	ml.Samples = append(ml.Samples, stats)
+
+	if len(ml.Samples) > lagHistory {
+		ml.Samples = append(ml.Samples[:0], ml.Samples[len(ml.Samples)-lagHistory:]...)
+	}
+
+	// the ejection policy needs to know how long the member has been lagging
+	if ejectPolicy != "" && ejectQueue > 0 && stats.ApplierQueue >= ejectQueue {
+		if ml.LaggingSince == nil {
+			since := stats.Time
+			ml.LaggingSince = &since
+		}
+	} else {
+		ml.LaggingSince = nil
+		ml.ejectBlocked = false
+	}
+
+	previous := ml.Level
+	ml.Level = lagLevel(stats.QueueLength())
+	level := ml.Level
+
+	lagSeries.Unlock()
+
+	if level == previous {
+		return
+	}
+
+	severity := notify.SeverityWarning
+	message := fmt.Sprintf("The member's replication lag is now %s, with %d transaction(s) queued to certify and apply", level, stats.QueueLength())
+
+	switch level {
+	case lagCritical:
+		severity = notify.SeverityCritical
+	case lagOK:
+		severity = notify.SeverityInfo
+	}
+
+	logLevel := slog.LevelWarn
+	if level == lagOK {
+		logLevel = slog.LevelInfo
+	}
+
+	nodeLogger(logger, member).Log(context.Background(), logLevel, "Replication lag level changed", "lag_level", level, "previous_lag_level", previous, "certifier_queue", stats.CertifierQueue, "applier_queue", stats.ApplierQueue, "flow_control_active", stats.FlowControlActive)
+
+	ev := nodeEvent(notify.EventReplicationLag, severity, member, "", message)
+	ev.Details["lag_level"] = level
+	ev.Details["certifier_queue"] = stats.CertifierQueue
+	ev.Details["applier_queue"] = stats.ApplierQueue
+	ev.Details["flow_control_active"] = stats.FlowControlActive
+	ev.Details["flow_control_throttles"] = stats.FlowControlThrottles
+	events.Publish(ev)
+}
+
+// lagHandler serves the recent replication stats of each member, or just one via ?member=<server uuid or host:port>
+func lagHandler(httpW http.ResponseWriter, httpR *http.Request) {
+	Log.Debug("Handling HTTP request for lag")
+
+	filter := httpR.URL.Query().Get("member")
+	lags := []memberLag{}
+
+	lagSeries.RLock()
+	for _, ml := range lagSeries.members {
+		if filter == "" || filter == ml.ServerUUID || filter == ml.Endpoint {
+			lag := *ml
+			lag.Samples = append([]group.MemberStats{}, ml.Samples...)
+			lags = append(lags, lag)
+		}
+	}
+	lagSeries.RUnlock()
+
+	sort.Slice(lags, func(i, j int) bool {
+		return lags[i].Endpoint < lags[j].Endpoint
+	})
+
+	if filter != "" && len(lags) == 0 {
+		http.Error(httpW, "No replication stats found for member: "+filter, http.StatusNotFound)
+		return
+	}
+
+	lagJSON, err := json.MarshalIndent(lags, "", "    ")
+
+	if err != nil {
+		Log.Error("Error handling HTTP request for lag", logging.KeyError, err)
+	}
+
+	httpW.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(httpW, "%s", lagJSON)
+}
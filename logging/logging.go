@@ -0,0 +1,71 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package logging
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// The field names used consistently across the arbitrator, so that our log pipeline can index them
+const (
+	KeyCluster    = "cluster"
+	KeyNode       = "node"
+	KeyServerUUID = "server_uuid"
+	KeyLoop       = "loop"
+	KeyDecisionID = "decision_id"
+	KeyError      = "error"
+)
+
+// The supported output formats
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// New returns a leveled logger writing structured records to w, in either JSON or logfmt format
+func New(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	var handler slog.Handler
+	opts := &slog.HandlerOptions{Level: level, AddSource: level <= slog.LevelDebug}
+
+	switch strings.ToLower(format) {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	case FormatLogfmt, "":
+		// the text handler writes key=value pairs, which is logfmt
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, errors.New("Unknown log format '" + format + "', the supported formats are: json, logfmt")
+	}
+
+	return slog.New(handler), nil
+}
+
+// ParseLevel converts the level names used on the command-line: debug, info, warn or error
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+
+	err := level.UnmarshalText([]byte(name))
+
+	if err != nil {
+		err = errors.New("Unknown log level '" + name + "', the supported levels are: debug, info, warn, error")
+	}
+
+	return level, err
+}
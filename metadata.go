@@ -0,0 +1,106 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/notify"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// useMetadata enables reading the topology from the InnoDB Cluster metadata that MySQL Shell maintains
+var useMetadata bool
+
+// metadataStats is what we last saw in the InnoDB Cluster metadata, presented as JSON via the "/stats" HTTP API call
+type metadataStats struct {
+	Version       int                         `json:"Metadata Version"`
+	Cluster       string                      `json:"Cluster Name,omitempty"`
+	Instances     []group.MetadataInstance    `json:"Instances"`
+	Discrepancies []group.MetadataDiscrepancy `json:"Discrepancies"`
+	Error         string                      `json:"Error,omitempty"`
+}
+
+// the discrepancies that we last reported, so that we only log and notify when they change
+var lastDiscrepancies string
+
+/*
+checkMetadata reads the InnoDB Cluster metadata via the seed node and reconciles it with the group membership. The
+members, and the seed node, get their labels from the metadata. Any members found in only one of them are flagged.
+*/
+func checkMetadata(logger *slog.Logger, seedNode *group.Node, members []group.Node) {
+	version, instances, err := seedNode.GetMetadataInstances()
+	mdStats := &metadataStats{Version: version, Instances: instances}
+
+	if err != nil {
+		mdStats.Error = err.Error()
+		logger.Debug("Could not read the InnoDB Cluster metadata", logging.KeyError, err)
+	} else {
+		mdStats.Cluster = instances[0].Cluster
+		mdStats.Discrepancies = group.ReconcileMetadata(instances, members)
+
+		for _, member := range members {
+			if member.ServerUuid == seedNode.ServerUuid {
+				seedNode.Label = member.Label
+			}
+		}
+
+		reportDiscrepancies(logger, seedNode, mdStats)
+	}
+
+	mystats.Lock()
+	mystats.Metadata = mdStats
+	mystats.Unlock()
+}
+
+func reportDiscrepancies(logger *slog.Logger, seedNode *group.Node, mdStats *metadataStats) {
+	var summary []string
+
+	for _, d := range mdStats.Discrepancies {
+		summary = append(summary, fmt.Sprintf("%s (%s) is %s", d.Address, d.ServerUUID, d.Problem))
+	}
+
+	sort.Strings(summary)
+	current := strings.Join(summary, "; ")
+
+	if current == lastDiscrepancies {
+		return
+	}
+
+	lastDiscrepancies = current
+
+	if current == "" {
+		logger.Info("The InnoDB Cluster metadata now matches the group membership", "innodb_cluster", mdStats.Cluster)
+		return
+	}
+
+	for _, d := range mdStats.Discrepancies {
+		logger.Warn("The InnoDB Cluster metadata does not match the group membership", "innodb_cluster", mdStats.Cluster, logging.KeyNode, d.Address, logging.KeyServerUUID, d.ServerUUID, "label", d.Label, "problem", d.Problem)
+	}
+
+	events.Publish(notify.Event{
+		Type:     notify.EventMetadataMismatch,
+		Severity: notify.SeverityWarning,
+		Cluster:  seedNode.GroupName,
+		Message:  "The InnoDB Cluster metadata does not match the group membership: " + current,
+		Details:  map[string]interface{}{"innodb_cluster": mdStats.Cluster, "discrepancies": mdStats.Discrepancies},
+	})
+}
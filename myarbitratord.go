@@ -17,33 +17,42 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
-	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 	// uncomment the next import to add profiling to the binary, available via "/debug/pprof" in the RESTful API
 	//_ "net/http/pprof"
+	"github.com/mattlord/myarbitratord/audit"
+	"github.com/mattlord/myarbitratord/credentials"
+	"github.com/mattlord/myarbitratord/discovery"
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/notify"
+	"github.com/mattlord/myarbitratord/recording"
 	"github.com/mattlord/myarbitratord/replication/group"
 )
 
 type MembersByOnlineNodes []group.Node
 
-var debug = false
+// events delivers our notifications, publishing to it is a no-op when no notifiers are configured
+var events *notify.Dispatcher
 
-var InfoLog = log.New(os.Stderr,
-	"INFO: ",
-	log.Ldate|log.Ltime|log.Lshortfile)
+var debug = false
 
-var DebugLog = log.New(os.Stderr,
-	"DEBUG: ",
-	log.Ldate|log.Ltime|log.Lshortfile)
+// Log is our structured logger, it's replaced once we've parsed the logging flags
+var Log = slog.New(slog.NewTextHandler(os.Stderr, nil))
 
 // This is where I'll store all operating status metrics, presented as JSON via the "/stats" HTTP API call
 type stats struct {
@@ -53,44 +62,50 @@ type stats struct {
 	Partitions  uint         `json:"Partitions"`
 	CurrentSeed group.Node   `json:"Current Seed Node"`
 	LastView    []group.Node `json:"Last Membership View"`
+	// the nodes that are currently rejecting our credentials, with the time of the first rejection
+	AuthFailures map[string]string `json:"Authentication Failures,omitempty"`
+	Pool         []group.PoolStats `json:"Connection Pool"`
+	Metadata     *metadataStats    `json:"InnoDB Cluster Metadata,omitempty"`
+	// Recovery is set when the last forced membership didn't unblock the group
+	Recovery *failedRecovery `json:"Failed Recovery,omitempty"`
+	// Reachability is the latest probe of each member's MySQL and XCom ports
+	Reachability []memberProbe `json:"Reachability,omitempty"`
 	sync.RWMutex
 }
 
-var mystats = stats{StartTime: time.Now().Format(time.RFC1123), Loops: 0, Partitions: 0}
+var mystats = stats{StartTime: time.Now().Format(time.RFC1123), Loops: 0, Partitions: 0, AuthFailures: make(map[string]string)}
 
 // This will simply note the available API calls
 func defaultHandler(httpW http.ResponseWriter, httpR *http.Request) {
-	if debug {
-		DebugLog.Println("Handling HTTP request without API call.")
-	}
+	Log.Debug("Handling HTTP request without API call")
 
-	fmt.Fprintf(httpW, "Welcome to the MySQL Arbitrator's RESTful API handler!\n\nThe available API calls are:\n/stats: Provide runtime and operational stats\n")
+	fmt.Fprintf(httpW, "Welcome to the MySQL Arbitrator's RESTful API handler!\n\nThe available API calls are:\n/stats: Provide runtime and operational stats\n/healthz: Check that the arbitrator is alive\n/readyz: Check that the arbitrator is monitoring a cluster\n/lag: Provide the recent replication stats for each member\n/breaker: Provide the state of the circuit breaker for each cluster\n/breaker/reset: POST to reset the circuit breaker, for the ?cluster=<group name> or all of them\n/force: Provide the forced membership that's awaiting approval\n/force/approve: POST to approve the forced membership with the ?decision=<decision ID>\n/reachability: Provide the reachability matrix, each member's view of the others, as JSON or with ?format=ascii as a table\n/simulate: POST a hypothetical cluster to see the decision that would be made for it, and why\n")
 }
 
 // This will serve the stats via a simple RESTful API
 func statsHandler(httpW http.ResponseWriter, httpR *http.Request) {
 	mystats.RLock()
 
-	if debug {
-		DebugLog.Printf("Handling HTTP request for stats.")
-	}
+	Log.Debug("Handling HTTP request for stats")
 
 	tval, terr := time.Parse(time.RFC1123, mystats.StartTime)
 	if terr != nil {
-		InfoLog.Printf("Error parsing time value for stats: %+v\n", terr)
+		Log.Error("Error parsing time value for stats", logging.KeyError, terr)
 	}
 	dval := time.Since(tval)
 
 	mystats.RUnlock()
 	mystats.Lock()
 	mystats.Uptime = dval.String()
+	mystats.Pool = group.DefaultPool.Stats()
+	mystats.Reachability = latestProbes()
 	mystats.Unlock()
 	mystats.RLock()
 
 	statsJSON, err := json.MarshalIndent(&mystats, "", "    ")
 
 	if err != nil {
-		InfoLog.Printf("Error handling HTTP request for stats: %+v\n", err)
+		Log.Error("Error handling HTTP request for stats", logging.KeyError, err)
 	}
 
 	fmt.Fprintf(httpW, "%s", statsJSON)
@@ -98,197 +113,582 @@ func statsHandler(httpW http.ResponseWriter, httpR *http.Request) {
 	mystats.RUnlock()
 }
 
+// the subcommands, which are run instead of the daemon via: myarbitratord <command> [flags]
+var commands = map[string]func(args []string) int{
+	"verify-audit": verifyAuditCommand,
+	"simulate":     simulateCommand,
+	"replay":       replayCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command, ok := commands[os.Args[1]]
+
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
+			os.Exit(1)
+		}
+
+		os.Exit(command(os.Args[2:]))
+	}
+
 	var seedHost string
 	var seedPort string
+	var seedFile string
+	var seedSRV string
 	var MySQLUser string
 	var MySQLPass string
 	var MySQLAuthFile string
-	type JSONMySQLAuth struct {
-		User     string `json:"user"`
-		Password string `json:"password"`
-	}
+	var MySQLDefaultsFile string
+	var MySQLDefaultsGroups string
+	var MySQLCredentialsDir string
+	var MySQLCredentialsMap string
+	var MySQLCredentialsRefresh time.Duration
+	var MySQLCredentialsGrace time.Duration
 
 	http.DefaultServeMux.HandleFunc("/", defaultHandler)
 	http.DefaultServeMux.HandleFunc("/stats", statsHandler)
+	http.DefaultServeMux.HandleFunc("/healthz", healthzHandler)
+	http.DefaultServeMux.HandleFunc("/readyz", readyzHandler)
+	http.DefaultServeMux.HandleFunc("/lag", lagHandler)
+	http.DefaultServeMux.HandleFunc("/breaker", breakerHandler)
+	http.DefaultServeMux.HandleFunc("/breaker/reset", breakerResetHandler)
+	http.DefaultServeMux.HandleFunc("/force", forceHandler)
+	http.DefaultServeMux.HandleFunc("/reachability", reachabilityHandler)
+	http.DefaultServeMux.HandleFunc("/force/approve", forceApproveHandler)
+	http.DefaultServeMux.HandleFunc("/simulate", simulateHandler)
 	var HTTPPort string
-
-	flag.StringVar(&seedHost, "seed-host", "", "IP/Hostname of the seed node used to start monitoring the Group Replication cluster (Required Parameter!)")
-	flag.StringVar(&seedPort, "seed-port", "3306", "Port of the seed node used to start monitoring the Group Replication cluster")
-	flag.BoolVar(&debug, "debug", false, "Execute in debug mode with all debug logging enabled")
+	var logFormat string
+	var auditLogFile string
+	var recordFile string
+	var notifyConfigFile string
+	var logLevel string
+	var MySQLMaxOpenConns int
+	var MySQLMaxIdleConns int
+	var MySQLPoolIdleTimeout time.Duration
+	var shutdownTimeout time.Duration
+	var stateMaxAge time.Duration
+
+	flag.StringVar(&seedHost, "seed-host", "", "Comma separated list of IP/Hostname[:port] of the seed nodes used to start monitoring the Group Replication cluster, tried in order (Required Parameter, unless -seed-file or -seed-srv is given!)")
+	flag.StringVar(&seedPort, "seed-port", "3306", "Port of the seed nodes used to start monitoring the Group Replication cluster, for those given without one")
+	flag.StringVar(&seedFile, "seed-file", "", "A file listing more seed nodes, one IP/Hostname[:port] per line")
+	flag.StringVar(&seedSRV, "seed-srv", "", "A DNS SRV record listing more seed nodes, e.g. _mysql._tcp.cluster1.example.com")
+	flag.BoolVar(&seeds.expandDNS, "seed-dns-expand", false, "Use every address in the A/AAAA records of each seed node's hostname as a seed node")
+	flag.BoolVar(&seeds.parallel, "seed-parallel", false, "Connect to all of the seed nodes at once and use the first ONLINE member found, rather than trying them in order")
+	flag.BoolVar(&debug, "debug", false, "Execute in debug mode with all debug logging enabled, the same as -log-level=debug")
+	flag.StringVar(&logFormat, "log-format", "logfmt", "The format of the log records written to stderr: json or logfmt")
+	flag.StringVar(&logLevel, "log-level", "info", "The minimum level of the log records written: debug, info, warn or error")
 	flag.StringVar(&MySQLUser, "mysql-user", "root", "The mysql user account to be used when connecting to any node in the cluster")
 	flag.StringVar(&MySQLPass, "mysql-password", "", "The mysql user account password to be used when connecting to any node in the cluster")
 	flag.StringVar(&MySQLAuthFile, "mysql-auth-file", "", "The JSON encoded file containining user and password entities for the mysql account to be used when connecting to any node in the cluster")
+	flag.StringVar(&MySQLDefaultsFile, "mysql-defaults-file", "", "A MySQL option file to read the user and password from, instead of ~/.my.cnf")
+	flag.StringVar(&MySQLDefaultsGroups, "mysql-defaults-group", "", "Comma separated list of option file groups to read after [client], later groups take precedence")
+	flag.StringVar(&MySQLCredentialsDir, "mysql-credentials-dir", "", "A directory containing one file per secret, named user and password (defaults to $CREDENTIALS_DIRECTORY when run by systemd)")
+	flag.StringVar(&MySQLCredentialsMap, "mysql-credentials-map", "", "The JSON encoded file containing per-node credentials, matched by server UUID (once known, after a first connection), host:port or label pattern (the instance labels are read with -innodb-cluster-metadata), for any nodes using a different mysql account")
+	flag.DurationVar(&MySQLCredentialsRefresh, "mysql-credentials-refresh", 0, "How often to re-read the mysql credentials so that they can be rotated without a restart, 0 means only on SIGHUP")
+	flag.DurationVar(&MySQLCredentialsGrace, "mysql-credentials-grace", 5*time.Minute, "How long the previous mysql credentials are still tried after they've been rotated")
 	flag.StringVar(&HTTPPort, "http-port", "8099", "The HTTP port used for the RESTful API")
+	flag.IntVar(&healthMaxIntervals, "health-max-intervals", healthMaxIntervals, "The /healthz API call reports a failure when the arbitrator hasn't completed a check of the cluster within this many loop intervals ("+loopInterval.String()+")")
+	flag.StringVar(&notifyConfigFile, "notify-config", "", "The JSON encoded file that configures the webhooks and email to notify about partitions, fencing and other events")
+	flag.StringVar(&recordFile, "record", "", "The gzip compressed NDJSON file where what's observed of the cluster on each loop is recorded, replay it with: myarbitratord replay <file>")
+	flag.StringVar(&auditLogFile, "audit-log", "", "The append-only, hash chained, file where every write sent to a mysqld is recorded, verify it with: myarbitratord verify-audit <file>")
+	flag.IntVar(&lagHistory, "lag-history", lagHistory, "How many samples of each member's replication stats to keep for the /lag API call, one being taken per loop")
+	flag.Uint64Var(&lagWarningQueue, "lag-warning", lagWarningQueue, "The number of transactions queued on a member, to certify and apply, at which its replication lag is a warning, 0 disables it")
+	flag.Uint64Var(&lagCriticalQueue, "lag-critical", lagCriticalQueue, "The number of transactions queued on a member, to certify and apply, at which its replication lag is critical, 0 disables it")
+	flag.StringVar(&ejectPolicy, "eject-lagging", "", "What to do with a member whose applier queue stays over -eject-queue for -eject-after: read-only (enable super_read_only) or stop (STOP GROUP_REPLICATION), disabled when empty")
+	flag.Uint64Var(&ejectQueue, "eject-queue", ejectQueue, "The applier queue size at which a member is considered to be lagging for -eject-lagging")
+	flag.DurationVar(&ejectAfter, "eject-after", ejectAfter, "How long a member must be lagging before it's ejected with -eject-lagging")
+	flag.IntVar(&maxShutdowns, "max-shutdowns", 0, "The most nodes that can be shut down within -action-window, after which the circuit breaker opens and the arbitrator is advisory-only until it's reset, 0 means unlimited")
+	flag.IntVar(&maxForceMembers, "max-force-members", 0, "The most times the membership can be forced within -action-window, after which the circuit breaker opens and the arbitrator is advisory-only until it's reset, 0 means unlimited")
+	flag.IntVar(&maxEjections, "max-ejections", 0, "The most lagging members that can be ejected within -action-window, after which the circuit breaker opens and the arbitrator is advisory-only until it's reset, 0 means unlimited")
+	flag.DurationVar(&actionWindow, "action-window", actionWindow, "The window within which -max-shutdowns, -max-force-members and -max-ejections are counted")
+	flag.DurationVar(&forceConfirmDelay, "force-confirm-delay", 0, "How long to wait, once no partition has a quorum, before probing all of the members again to confirm the membership to force, 0 means it's forced right away")
+	flag.BoolVar(&forceApproval, "force-approval", false, "Require an operator to approve each forced membership via the /force/approve API call before it's done")
+	flag.DurationVar(&forceVerifyTimeout, "force-verify-timeout", forceVerifyTimeout, "How long to wait, after forcing the membership, for the forced members to be ONLINE with a quorum before fencing the others, after which the arbitrator stops in the FAILED_RECOVERY state")
+	flag.BoolVar(&probeXCom, "xcom-probe", true, "Probe each member's GCS/XCom port, as well as its MySQL port, to tell a mysqld that's down from a broken group communication link")
+	flag.DurationVar(&probeInterval, "xcom-probe-interval", probeInterval, "How often to probe the members' MySQL and XCom ports while the seed node has a quorum, they're probed on every loop when it doesn't")
+	flag.DurationVar(&group.XComProbeTimeout, "xcom-probe-timeout", group.XComProbeTimeout, "How long to wait for a member's MySQL or XCom port to accept a TCP connection when probing it")
+	flag.IntVar(&minOnlineMembers, "min-online-members", minOnlineMembers, "Refuse to shut down a node or force the membership when it would leave fewer ONLINE members than this, or ONLINE members that aren't a majority")
+	flag.BoolVar(&useMetadata, "innodb-cluster-metadata", false, "Read the cluster's topology and instance labels from the InnoDB Cluster metadata schema maintained by MySQL Shell, flagging any members not found in both it and the group")
+	flag.StringVar(&stateFile, "state-file", "", "The file where the last known membership view is saved after each loop, so that it can be used to find the cluster after a restart")
+	flag.DurationVar(&stateMaxAge, "state-max-age", time.Hour, "The state file is ignored at startup when it was saved longer ago than this, 0 means no limit")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait on SIGTERM or SIGINT for any in-flight action, e.g. forcing the membership, to complete before exiting anyway")
+	flag.IntVar(&MySQLMaxOpenConns, "mysql-max-open-conns", 2, "The maximum number of open connections to each node in the cluster, 0 means unlimited")
+	flag.IntVar(&MySQLMaxIdleConns, "mysql-max-idle-conns", 1, "The maximum number of idle connections kept open to each node in the cluster")
+	flag.DurationVar(&group.ConnectTimeout, "mysql-connect-timeout", group.ConnectTimeout, "How long to wait for a connection to a mysqld, this plus 6 times -mysql-io-timeout must be less than -health-max-intervals loop intervals")
+	flag.DurationVar(&group.IOTimeout, "mysql-io-timeout", group.IOTimeout, "How long to wait on a read from or a write to a mysqld connection, e.g. for a query's results")
+	flag.DurationVar(&MySQLPoolIdleTimeout, "mysql-pool-idle-timeout", 10*time.Minute, "How long the connections to a node can go unused, e.g. after it left the group, before they're closed")
 
 	flag.Parse()
 
 	// ToDo: I need to handle the password on the command-line more securely
 	//       I need to do some data masking for the processlist
 
-	// A host is required, the default port of 3306 will then be attempted
-	if seedHost == "" {
-		fmt.Fprintf(os.Stderr, "No value specified for required flag: -seedHost\n")
+	// A seed node is required, the default port of 3306 will then be attempted
+	if seedHost == "" && seedFile == "" && seedSRV == "" {
+		fmt.Fprintf(os.Stderr, "No value specified for required flag: -seed-host (or -seed-file or -seed-srv)\n")
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	// let's start a thread to handle the RESTful API calls
-	InfoLog.Printf("Starting HTTP server for RESTful API on port %s\n", HTTPPort)
-	go http.ListenAndServe(":"+HTTPPort, http.DefaultServeMux)
+	if !validEjectPolicy(ejectPolicy) {
+		fmt.Fprintf(os.Stderr, "Invalid value for -eject-lagging: %s, the valid values are: read-only, stop\n", ejectPolicy)
+		os.Exit(exitConfigError)
+	}
+
+	if maxShutdowns < 0 || maxForceMembers < 0 || maxEjections < 0 || actionWindow <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid action budget: -max-shutdowns, -max-force-members and -max-ejections can't be negative, and -action-window must be positive\n")
+		os.Exit(exitConfigError)
+	}
+
+	if forceConfirmDelay < 0 || forceVerifyTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -force-confirm-delay or -force-verify-timeout, they can't be negative\n")
+		os.Exit(exitConfigError)
+	}
+
+	if group.XComProbeTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -xcom-probe-timeout: %s, it must be positive\n", group.XComProbeTimeout)
+		os.Exit(exitConfigError)
+	}
+
+	if lagHistory < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -lag-history: %d, it must be at least 1\n", lagHistory)
+		os.Exit(exitConfigError)
+	}
+
+	if healthMaxIntervals < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -health-max-intervals: %d, it must be at least 1\n", healthMaxIntervals)
+		os.Exit(exitConfigError)
+	}
+
+	// a single step against an unreachable member must never look like we're stuck to the watchdog
+	if healthLimit := time.Duration(healthMaxIntervals) * loopInterval; group.ConnectTimeout <= 0 || group.IOTimeout <= 0 || group.StepTimeout() >= healthLimit {
+		fmt.Fprintf(os.Stderr, "Invalid value for -mysql-connect-timeout or -mysql-io-timeout, they must be positive and -mysql-connect-timeout plus 6 times -mysql-io-timeout (%s), the most that one member can take, must be less than %s (-health-max-intervals loop intervals)\n", group.StepTimeout(), healthLimit)
+		os.Exit(exitConfigError)
+	}
+
+	if minOnlineMembers < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -min-online-members: %d, it must be at least 1\n", minOnlineMembers)
+		os.Exit(exitConfigError)
+	}
+
+	level, err := logging.ParseLevel(logLevel)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 
 	if debug {
-		group.Debug = true
+		level = slog.LevelDebug
+	}
+
+	Log, err = logging.New(os.Stderr, logFormat, level)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
 	}
 
-	if MySQLAuthFile != "" && MySQLPass == "" {
-		if debug {
-			DebugLog.Printf("Reading MySQL credentials from file: %s\n", MySQLAuthFile)
+	group.Log = Log
+
+	// let's start a thread to handle the RESTful API calls
+	Log.Info("Starting HTTP server for RESTful API", "port", HTTPPort)
+	httpServer := &http.Server{Addr: ":" + HTTPPort, Handler: http.DefaultServeMux}
+
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			Log.Error("The HTTP server for the RESTful API failed", logging.KeyError, err)
 		}
+	}()
+
+	group.DefaultPool.MaxOpen = MySQLMaxOpenConns
+	group.DefaultPool.MaxIdle = MySQLMaxIdleConns
+	group.DefaultPool.IdleTimeout = MySQLPoolIdleTimeout
+
+	credConfig := credentials.Config{
+		User:           MySQLUser,
+		Password:       MySQLPass,
+		AuthFile:       MySQLAuthFile,
+		DefaultsFile:   MySQLDefaultsFile,
+		CredentialsDir: MySQLCredentialsDir,
+	}
+
+	if MySQLDefaultsGroups != "" {
+		credConfig.DefaultsGroups = strings.Split(MySQLDefaultsGroups, ",")
+	}
+
+	// we need to know if the user was explicitly specified, as that overrides the user from any other source
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "mysql-user" {
+			credConfig.UserSet = true
+		}
+	})
+
+	creds, err := credentials.Load(credConfig)
+
+	if err != nil {
+		Log.Error("Could not load the mysql credentials", logging.KeyError, err)
+		os.Exit(1)
+	}
+
+	// the Credentials type masks the password, so it's safe to log
+	Log.Info("Using mysql credentials", "credentials", creds)
+	group.SetCredentials(creds.User, creds.Password, MySQLCredentialsGrace)
+
+	overrides, err := loadCredentialOverrides(MySQLCredentialsMap)
 
-		JSONFile, err := ioutil.ReadFile(MySQLAuthFile)
+	if err != nil {
+		Log.Error("Could not load the per-node mysql credentials", logging.KeyError, err)
+		os.Exit(1)
+	}
+
+	group.SetCredentialOverrides(overrides, MySQLCredentialsGrace)
+	go watchCredentials(credConfig, MySQLCredentialsMap, MySQLCredentialsRefresh, MySQLCredentialsGrace)
+
+	if auditLogFile != "" {
+		auditor.log, err = audit.Open(auditLogFile, Log)
 
 		if err != nil {
-			log.Fatal("Could not read mysql credentials from specified file: " + MySQLAuthFile)
+			Log.Error("Could not open the audit log", logging.KeyError, err)
+			os.Exit(1)
 		}
 
-		var JSONAuth JSONMySQLAuth
-		json.Unmarshal(JSONFile, &JSONAuth)
+		group.Audit = auditor
+	}
+
+	if recordFile != "" {
+		recorder.out, err = recording.Create(recordFile)
 
-		if debug {
-			DebugLog.Printf("Unmarshaled mysql auth file contents: %+v\n", JSONAuth)
+		if err != nil {
+			Log.Error("Could not open the recording", logging.KeyError, err)
+			os.Exit(1)
 		}
+	}
 
-		MySQLUser = JSONAuth.User
-		MySQLPass = JSONAuth.Password
+	if notifyConfigFile != "" {
+		notifyConfig, err := notify.LoadConfig(notifyConfigFile)
 
-		if MySQLUser == "" || MySQLPass == "" {
-			errstr := "Failed to read user and password from " + MySQLAuthFile + ". Ensure that the file contents are in the required format: \n{\n  \"user\": \"myser\",\n  \"password\": \"mypass\"\n}"
-			log.Fatal(errstr)
+		if err == nil {
+			events = notify.NewDispatcher(100, Log)
+			err = events.Setup(notifyConfig)
 		}
 
-		if debug {
-			DebugLog.Printf("Read mysql auth info from file. user: %s, password: %s\n", MySQLUser, MySQLPass)
+		if err != nil {
+			Log.Error("Could not setup the notifications", logging.KeyError, err)
+			os.Exit(1)
 		}
 	}
 
-	InfoLog.Println("Welcome to the MySQL Group Replication Arbitrator!")
+	Log.Info("Welcome to the MySQL Group Replication Arbitrator!")
+
+	seeds.user = creds.User
+	seeds.password = creds.Password
 
-	InfoLog.Printf("Starting operations from seed node: '%s:%s'\n", seedHost, seedPort)
-	seedNode := group.New(seedHost, seedPort, MySQLUser, MySQLPass)
-	err := MonitorCluster(*seedNode)
+	if seeds.static, err = discovery.ParseList(seedHost, seedPort); err == nil && seedFile != "" {
+		var fileSeeds []discovery.Endpoint
+		fileSeeds, err = discovery.ReadFile(seedFile, seedPort)
+		seeds.static = append(seeds.static, fileSeeds...)
+	}
 
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(100)
+		Log.Error("Could not parse the seed nodes", logging.KeyError, err)
+		os.Exit(exitConfigError)
+	}
+
+	seeds.srv = seedSRV
+
+	lastView := restoreView(stateFile, stateMaxAge)
+	restoreBreaker(stateFile)
+	seedEndpoints := seeds.resolve()
+	seedNode := &group.Node{}
+
+	// we'll start with the first seed node, and MonitorCluster will look for another if it can't be used
+	if len(seedEndpoints) > 0 {
+		seedNode = group.New(seedEndpoints[0].Host, seedEndpoints[0].Port, creds.User, creds.Password)
+	} else if len(lastView) > 0 {
+		seedNode = &lastView[0]
 	} else {
-		os.Exit(0)
+		Log.Error("No seed nodes were found", "seed_srv", seedSRV, "seed_file", seedFile)
+		os.Exit(exitConfigError)
+	}
+
+	Log.Info("Starting operations from seed node", logging.KeyNode, seedNode.MySQLHost+":"+seedNode.MySQLPort, "seed_nodes", len(seedEndpoints))
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go handleSignals(cancel, stopped, shutdownTimeout)
+
+	notifyReady()
+
+	err = MonitorCluster(ctx, *seedNode, lastView)
+
+	close(stopped)
+	notifyStopping()
+
+	if err != nil {
+		events.Publish(notify.Event{Type: notify.EventArbitratorErr, Severity: notify.SeverityCritical, Message: "Monitoring the cluster failed: " + err.Error()})
+	}
+
+	// let's give any queued notifications a chance to be delivered before we exit
+	if cerr := events.Close(30 * time.Second); cerr != nil {
+		Log.Error("Not all notifications were delivered", logging.KeyError, cerr)
+	}
+
+	group.DefaultPool.Close()
+	auditor.close()
+	recorder.close()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	if serr := httpServer.Shutdown(shutdownCtx); serr != nil {
+		Log.Error("Could not cleanly shut down the HTTP server", logging.KeyError, serr)
+	}
+	cancelShutdown()
+
+	if err != nil {
+		Log.Error("Monitoring the cluster failed", logging.KeyError, err)
+		os.Exit(exitMonitorFailed)
+	}
+
+	Log.Info("The arbitrator has shut down cleanly")
+	os.Exit(exitOK)
+}
+
+// watchCredentials re-reads the credentials periodically and on SIGHUP, so that they can be rotated without a restart
+func watchCredentials(credConfig credentials.Config, mapFile string, interval time.Duration, grace time.Duration) {
+	var tick <-chan time.Time
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	for {
+		select {
+		case <-hup:
+			Log.Info("Received SIGHUP, re-reading the mysql credentials")
+		case <-tick:
+			Log.Debug("Re-reading the mysql credentials")
+		}
+
+		creds, err := credentials.Load(credConfig)
+
+		if err != nil {
+			Log.Error("Error re-reading the mysql credentials, continuing to use the current ones", logging.KeyError, err)
+			continue
+		}
+
+		if group.SetCredentials(creds.User, creds.Password, grace) {
+			Log.Info("The mysql credentials have changed", "credentials", creds)
+		}
+
+		overrides, err := loadCredentialOverrides(mapFile)
+
+		if err != nil {
+			Log.Error("Error re-reading the per-node mysql credentials, continuing to use the current ones", logging.KeyError, err)
+			continue
+		}
+
+		if group.SetCredentialOverrides(overrides, grace) {
+			Log.Info("The per-node mysql credentials have changed", "entries", len(overrides))
+		}
+	}
+}
+
+// loadCredentialOverrides reads the per-node credentials file for the group package
+func loadCredentialOverrides(mapFile string) ([]group.CredentialOverride, error) {
+	entries, err := credentials.LoadOverrides(mapFile)
+	overrides := make([]group.CredentialOverride, 0, len(entries))
+
+	for _, entry := range entries {
+		Log.Debug("Read per-node mysql credentials", "entry", entry)
+
+		overrides = append(overrides, group.CredentialOverride{
+			ServerUUID:  entry.ServerUUID,
+			Endpoint:    entry.Endpoint,
+			Label:       entry.Label,
+			Credentials: group.Credentials{User: entry.User, Password: entry.Password},
+		})
+	}
+
+	return overrides, err
+}
+
+// noteConnectResult tracks which nodes are rejecting our credentials, as that's a distinct problem from a node being down
+func noteConnectResult(node *group.Node, err error) {
+	endpoint := node.MySQLHost + ":" + node.MySQLPort
+
+	mystats.Lock()
+	defer mystats.Unlock()
+
+	if group.IsAuthError(err) {
+		if _, ok := mystats.AuthFailures[endpoint]; !ok {
+			Log.Warn("Authentication failed, our credentials were rejected", logging.KeyNode, endpoint, logging.KeyServerUUID, node.ServerUuid)
+			mystats.AuthFailures[endpoint] = time.Now().Format(time.RFC1123)
+		}
+	} else if err == nil {
+		delete(mystats.AuthFailures, endpoint)
 	}
 }
 
-func MonitorCluster(seedNode group.Node) error {
-	loop := true
+/*
+MonitorCluster checks the cluster and handles any problems found until the context is cancelled, at which point it
+completes any decision already in progress and returns. It returns an error when it can't carry on, which is when the
+audit log can no longer be written.
+*/
+func MonitorCluster(ctx context.Context, seedNode group.Node, lastView []group.Node) error {
 	var err error
-	lastView := []group.Node{}
+	// so that a state file that can't be written is only logged when that first happens, not on every loop
+	var lastStateErr string
+
+	for ctx.Err() == nil {
+		health.heartbeat()
 
-	for loop == true {
 		mystats.Lock()
 		mystats.Loops = mystats.Loops + 1
 		mystats.CurrentSeed = seedNode
 		// Setting the slice to nil will clear it and properly release all of the previous contents for the GC
 		mystats.LastView = nil
 		mystats.LastView = lastView
+		loopNum := mystats.Loops
+		// every record logged during this loop will note which loop it came from
+		logger := Log.With(logging.KeyLoop, loopNum)
 		mystats.Unlock()
 
 		// let's check the status of the current seed node
 		err = seedNode.Connect()
+		noteConnectResult(&seedNode, err)
 		defer seedNode.Cleanup()
 
 		if err != nil || seedNode.MemberState != "ONLINE" {
 			// if we couldn't connect to the current seed node or it's no longer part of the group
-			// let's try and get a new seed node from the last known membership view
-			InfoLog.Println("Attempting to get a new seed node...")
-
-			for i := 0; i < len(lastView); i++ {
-				if seedNode != lastView[i] {
-					err = lastView[i].Connect()
-					defer lastView[i].Cleanup()
+			// let's try and get a new seed node from the last known membership view, or the configured seed nodes
+			logger.Info("Attempting to get a new seed node...", logging.KeyNode, seedNode.MySQLHost+":"+seedNode.MySQLPort, logging.KeyError, err)
 
-					if err == nil && lastView[i].MemberState == "ONLINE" {
-						seedNode = lastView[i]
-						InfoLog.Printf("Updated seed node! New seed node is: '%s:%s'\n", seedNode.MySQLHost, seedNode.MySQLPort)
-						break
-					}
-				}
+			var newSeed group.Node
 
-				lastView[i].Cleanup()
+			if newSeed, err = findSeed(logger, seeds.candidates(seedNode, lastView), seeds.parallel); err == nil {
+				seedNode = newSeed
+				nodeLogger(logger, &seedNode).Info("Updated seed node!")
 			}
 		}
 
 		// If we still don't have a valid seed node...
 		if err != nil || seedNode.MemberState != "ONLINE" {
+			health.setNotReady("No valid seed node could be found")
+			recorder.failed(logger, loopNum, seedNode, "No valid seed node could be found")
 			// if we already have a valid list of nodes to re-try, then let's "reset" it before we loop again
 			if len(lastView) > 0 {
 				seedNode.Reset()
 			}
-			time.Sleep(time.Millisecond * 1000)
+			sleepContext(ctx, time.Second)
 			continue
 		}
 
 		members, err := seedNode.GetMembers()
 
 		if err != nil || seedNode.OnlineParticipants < 1 {
+			health.setNotReady("Could not get the membership view from the seed node")
+			recorder.failed(logger, loopNum, seedNode, "Could not get the membership view from the seed node")
 			// Something is still fishy with our seed node
 			// if we already have a valid list of nodes to re-try, then let's "reset" it before we loop again
 			if len(lastView) > 0 {
 				seedNode.Reset()
 			}
-			time.Sleep(time.Millisecond * 1000)
+			sleepContext(ctx, time.Second)
 			continue
 		}
 
 		quorum, err := seedNode.HasQuorum()
 
 		if err != nil {
+			health.setNotReady("Could not determine if the seed node has quorum")
+			recorder.failed(logger, loopNum, seedNode, "Could not determine if the seed node has quorum")
 			// Something is still fishy with our seed node
 			// if we already have a valid list of nodes to re-try, then let's "reset" it before we loop again
 			if len(lastView) > 0 {
 				seedNode.Reset()
 			}
-			time.Sleep(time.Millisecond * 1000)
+			sleepContext(ctx, time.Second)
 			continue
 		}
 
-		if debug {
-			DebugLog.Printf("Seed node details: %+v", seedNode)
+		health.setReady(&seedNode, len(members), quorum)
+
+		if useMetadata {
+			checkMetadata(logger, &seedNode, members)
 		}
 
+		// so that we can tell a mysqld that's down from a broken group communication link
+		probes := probeMembers(logger, members, quorum)
+		// and how each of the members sees the group
+		matrix := collectReachability(logger, members)
+		// and what we've observed of the group, for replaying it offline
+		recorder.observed(logger, loopNum, seedNode, matrix, probes)
+
+		if quorum {
+			collectLag(logger, members)
+			ejectLagging(logger, loopNum, seedNode, members)
+		}
+
+		logger = logger.With(logging.KeyCluster, seedNode.GroupName)
+		nodeLogger(logger, &seedNode).Debug("Seed node details", "seed", seedNode)
+
 		if quorum {
+			abandonForce(logger, "the group has a quorum again")
+			clearFailedRecovery(logger, "the group has a quorum again")
+
 			// Let's see if there are any nodes that are no longer fully functioning members of the group and then take action
 
-			for i := 0; i < len(lastView); i++ {
+			// each node is a separate decision, so once we're shutting down we won't start on the next one
+			for i := 0; i < len(lastView) && ctx.Err() == nil; i++ {
+				// each member can take up to the mysql timeouts, so we keep the heartbeat going
+				health.heartbeat()
+
 				if seedNode != lastView[i] {
 					err = lastView[i].Connect()
+					noteConnectResult(&lastView[i], err)
 					defer lastView[i].Cleanup()
 
 					if err == nil {
-						// If Group Replication has been stopped, then let's set super_read_only mode to protect consistency
-						// But not shut it down, as the DBA may need to perform some maintenance
-						if lastView[i].MemberState == "OFFLINE" {
-							InfoLog.Printf("Enabling read only mode on OFFLINE node: '%s:%s'\n", lastView[i].MySQLHost, lastView[i].MySQLPort)
-
-							lastView[i].SetReadOnly(true)
-						} else {
+						// the node's quorum doesn't matter once Group Replication has been stopped on it
+						if lastView[i].MemberState != "OFFLINE" {
 							quorum, err = lastView[i].HasQuorum()
+						}
+
+						action, reason := memberAction(lastView[i].MemberState, quorum)
+
+						switch action {
+						case decideReadOnly:
+							decisionID := newDecisionID()
+							nodeLogger(logger, &lastView[i]).Info("Enabling read only mode on OFFLINE node", logging.KeyDecisionID, decisionID)
 
-							// If this node sees itself in the ERROR state or doesn't think it has a quorum, then it should be safe to shut it down
-							if lastView[i].MemberState == "ERROR" || quorum == false {
-								InfoLog.Printf("Shutting down non-healthy node: '%s:%s'\n", lastView[i].MySQLHost, lastView[i].MySQLPort)
-								err = lastView[i].Shutdown()
+							auditor.justify(decisionID, reason, newSnapshot(loopNum, seedNode, true, lastView))
+							err = lastView[i].SetReadOnly(true)
+							events.Publish(actionEvent(notify.EventReadOnly, &lastView[i], decisionID, "Enabled super_read_only on the OFFLINE node", err))
+						case decideShutdown:
+							decisionID := newDecisionID()
+
+							// but only if the rest of the group, as the seed node currently sees it, can carry on without it
+							if gerr := guardAction("Shutting down "+lastView[i].MySQLHost+":"+lastView[i].MySQLPort, members, lastView[i]); gerr != nil {
+								refuseAction(logger, &lastView[i], decisionID, gerr)
+								lastView[i].Cleanup()
+								continue
 							}
-						} // if we couldn't connect, then not much we can do...
-					}
+
+							if !allowAction(logger, actionShutdown, seedNode.GroupName, &lastView[i], decisionID) {
+								lastView[i].Cleanup()
+								continue
+							}
+
+							nodeLogger(logger, &lastView[i]).Info("Shutting down non-healthy node", logging.KeyDecisionID, decisionID, "member_state", lastView[i].MemberState, "quorum", quorum)
+
+							auditor.justify(decisionID, reason, newSnapshot(loopNum, seedNode, true, lastView))
+							err = lastView[i].Shutdown()
+							events.Publish(actionEvent(notify.EventNodeShutdown, &lastView[i], decisionID, fmt.Sprintf("Shut down the non-healthy node (member state: %s, quorum: %t)", lastView[i].MemberState, quorum), err))
+						}
+					} // if we couldn't connect, then not much we can do...
 
 					lastView[i].Cleanup()
 				}
@@ -300,79 +700,58 @@ func MonitorCluster(seedNode group.Node) error {
 			// membership with 'set global group_replication_force_members="<node_list>"'. Finally we'll need to try
 			// and connect to the nodes on the losing side(s) of the partition and attempt to shutdown the mysqlds
 
-			InfoLog.Println("Network partition detected! Attempting to handle... ")
-			mystats.Lock()
-			mystats.Partitions = mystats.Partitions + 1
-			mystats.Unlock()
-
-			// does anyone have a quorum? Let's double check before forcing the membership
-			PrimaryPartition := false
+			// once we're shutting down we shouldn't start handling a partition that we may not be able to finish
+			if ctx.Err() != nil {
+				logger.Warn("Network partition detected, but not handling it as we're shutting down")
+				break
+			}
 
-			for i := 0; i < len(lastView); i++ {
-				var err error
+			// all of the actions taken to handle this partition are part of the same decision, which carries on over
+			// the following loops while the forced membership is awaiting approval or it failed to recover the group
+			decisionID, ongoing := partitionDecisionID()
+			logger = logger.With(logging.KeyDecisionID, decisionID)
 
-				err = lastView[i].Connect()
-				defer lastView[i].Cleanup()
+			if ongoing {
+				logger.Info("Network partition still being handled")
+			} else {
+				logger.Warn("Network partition detected! Attempting to handle... ")
+				partitionEvent := nodeEvent(notify.EventPartition, notify.SeverityWarning, &seedNode, decisionID, "Network partition detected, the seed node has lost its quorum")
 
-				if err == nil {
-					quorum, err = lastView[i].HasQuorum()
-					// let's make sure that the OnlineParticipants is up to date
-					_, err = lastView[i].GetMembers()
+				if probes != nil {
+					partitionEvent.Details["reachability"] = probeSummary(probes)
 				}
 
-				if err == nil && quorum {
-					seedNode = lastView[i]
-					PrimaryPartition = true
-					break
-				}
+				partitionEvent.Details["partitions"] = matrix.Partitions
 
-				lastView[i].Cleanup()
+				events.Publish(partitionEvent)
+				mystats.Lock()
+				mystats.Partitions = mystats.Partitions + 1
+				mystats.Unlock()
 			}
 
-			// If no one in fact has a quorum, then let's see which partition has the most
-			// online/participating/communicating members. The participants in that partition
-			// will then be the ones that we use to force the new membership and unlock the cluster
-			if PrimaryPartition == false && len(lastView) > 0 {
-				InfoLog.Println("No primary partition found! Attempting to choose and force a new one ... ")
+			// does anyone have a quorum? Let's double check before forcing the membership
+			primaryNode, PrimaryPartition := findPrimaryPartition(lastView)
 
-				sort.Sort(MembersByOnlineNodes(lastView))
+			if PrimaryPartition {
+				seedNode = primaryNode
+				abandonForce(logger, "the partition of "+seedNode.MySQLHost+":"+seedNode.MySQLPort+" has a quorum")
+				clearFailedRecovery(logger, "the partition of "+seedNode.MySQLHost+":"+seedNode.MySQLPort+" has a quorum")
+			}
 
-				if debug {
-					DebugLog.Printf("Member view sorted by number of online nodes: %+v\n", lastView)
+			// If no one in fact has a quorum, then let's see which partition has the most
+			// online/participating/communicating members. The participants in that partition
+			// will then be the ones that we use to force the new membership and unlock the cluster. Unless the last
+			// forced membership failed to recover the group, as then it's up to a human to sort out
+			if PrimaryPartition == false && len(lastView) > 0 && !recoveryFailed(logger) {
+				if !ongoing {
+					logger.Warn("No primary partition found! Attempting to choose and force a new one ... ")
+					events.Publish(notify.Event{Type: notify.EventQuorumLoss, Severity: notify.SeverityCritical, Cluster: seedNode.GroupName, DecisionID: decisionID, Message: "No partition has a quorum, the group is blocked"})
 				}
 
-				// now the last element in the array is the one to use as it's coordinating with the most nodes
-				ViewLen := len(lastView) - 1
-				seedNode = lastView[ViewLen]
-
-				// *BUT*, if there's no clear winner based on sub-partition size, then we should pick the sub-partition (which
-				// can be 1 node) that has executed the most GTIDs
-				if ViewLen >= 1 && lastView[ViewLen].OnlineParticipants == lastView[ViewLen-1].OnlineParticipants {
-					bestmemberpos := ViewLen
-					var bestmembertrxcnt uint64
-					var curtrxcnt uint64
-					bestmembertrxcnt, err = lastView[ViewLen].TransactionsExecutedCount()
-
-					// let's loop backwards through the array as it's sorted by online participants / partition size now
-					// skipping the last one as we already have the info for it
-					for i := ViewLen - 1; i >= 0; i-- {
-						if lastView[i].OnlineParticipants == lastView[bestmemberpos].OnlineParticipants {
-							curtrxcnt, err = lastView[i].TransactionsExecutedCount()
-
-							if curtrxcnt > bestmembertrxcnt {
-								bestmembertrxcnt = curtrxcnt
-								bestmemberpos = i
-							}
-						} else {
-							// otherwise we've gone backwards far enough and we have the best option
-							break
-						}
-					}
-
-					seedNode = lastView[bestmemberpos]
-				}
+				seedNode = pickForceCandidate(logger, lastView)
 
 				err = seedNode.Connect()
+				noteConnectResult(&seedNode, err)
 				defer seedNode.Cleanup()
 
 				if err != nil {
@@ -381,61 +760,112 @@ func MonitorCluster(seedNode group.Node) error {
 					if len(lastView) > 0 {
 						seedNode.Reset()
 					}
-					time.Sleep(time.Millisecond * 1000)
+					sleepContext(ctx, time.Second)
 					continue
 				}
 
 				// let's build a string of '<host>:<port>' combinations that we want to use for the new membership view
 				members, _ := seedNode.GetMembers()
 
-				forceMemberString := ""
-				var memberGCSAddr string
+				// what we can observe of each member, to decide on the membership of the new primary partition
+				observed := make([]forceObservation, len(members))
+
+				for i := range members {
+					health.heartbeat()
 
-				for _, member := range members {
+					member := &members[i]
+					// the state that the candidate sees the member in, before it's replaced by the member's own
+					seen := member.MemberState
 					err = member.Connect()
+					noteConnectResult(member, err)
 					defer member.Cleanup()
 
-					if err == nil && member.MemberState == "ONLINE" {
-						if forceMemberString != "" {
-							forceMemberString = forceMemberString + ","
-						}
+					observed[i] = forceObservation{Node: *member, Reached: err == nil, Seen: seen}
 
+					if err == nil && member.MemberState == "ONLINE" {
 						// we need to get the GCS/XCom 'host:port' combination, which is different from the 'host:port' combination for mysqld
-						memberGCSAddr, err = member.GetGCSAddress()
+						observed[i].Endpoint, observed[i].EndpointErr = member.GetGCSEndpoint()
 
-						if err == nil {
-							forceMemberString = forceMemberString + memberGCSAddr
-						} else {
-							InfoLog.Printf("Problem getting GCS endpoint for '%s:%s': %+v\n", member.MySQLHost, member.MySQLPort, err)
+						if observed[i].EndpointErr != nil {
+							nodeLogger(logger, member).Error("Problem getting GCS endpoint", logging.KeyError, observed[i].EndpointErr)
 						}
-					} else {
-						member.MemberState = "SHOOT_ME"
 					}
 
 					member.Cleanup()
 				}
 
-				if forceMemberString != "" {
-					InfoLog.Printf("Forcing group membership to form new primary partition! Using: '%s'\n", forceMemberString)
+				decision := decideForce(observed, minOnlineMembers)
+				forcedMembers := decision.Forced
+				forceEndpoints := decision.Endpoints
+				// the value for group_replication_force_members, which is passed as a parameter when it's set
+				forceMemberString := decision.ForceMembers
+
+				// the members left out of the new primary partition are marked in the view, so that we can fence them
+				for i := range members {
+					if containsNode(decision.Losing, members[i]) {
+						members[i].MemberState = "SHOOT_ME"
+					}
+				}
+
+				// the GCS endpoints are only dialed here, as ForceMembers just checks them again
+				verr := decision.Blocked
+
+				if verr == nil {
+					verr = group.ValidateGCSEndpoints(forceEndpoints)
+				}
 
-					err := seedNode.ForceMembers(forceMemberString)
+				if verr == errNoForceMembers {
+					logger.Error("No valid group membership to force!")
+					events.Publish(nodeEvent(notify.EventArbitratorErr, notify.SeverityCritical, &seedNode, decisionID, "No valid group membership to force, the group remains blocked"))
+				} else if verr != nil {
+					logger.Error("Not forcing the membership as one of the GCS endpoints is not valid", "force_members", forceMemberString, logging.KeyError, verr)
+					events.Publish(nodeEvent(notify.EventArbitratorErr, notify.SeverityCritical, &seedNode, decisionID, "Not forcing the membership, the group remains blocked: "+verr.Error()))
+				} else if gerr := decision.Refused; gerr != nil {
+					refuseAction(logger, &seedNode, decisionID, gerr)
+				} else if note, confirmed := confirmForce(ctx, logger, decisionID, lastView, seedNode, forceMemberString, forcedMembers, members); confirmed && allowAction(logger, actionForceMembers, seedNode.GroupName, &seedNode, decisionID) {
+					nodeLogger(logger, &seedNode).Warn("Forcing group membership to form new primary partition!", "force_members", forceMemberString)
+
+					auditor.justify(decisionID, "No partition has a quorum, forcing the membership of the partition with the most online members (or the most GTIDs)"+note, newSnapshot(loopNum, seedNode, false, lastView))
+					err := seedNode.ForceMembers(forceEndpoints)
+
+					forceEvent := actionEvent(notify.EventForceMembers, &seedNode, decisionID, "Forced the group membership to form a new primary partition", err)
+					forceEvent.Details["force_members"] = forceMemberString
+					events.Publish(forceEvent)
 
 					if err != nil {
-						InfoLog.Printf("Error forcing group membership: %v\n", err)
+						nodeLogger(logger, &seedNode).Error("Error forcing group membership", logging.KeyError, err)
+					} else if verr := verifyForce(ctx, logger, forcedMembers); ctx.Err() != nil {
+						logger.Warn("Not fencing the nodes left out of the forced primary partition as we're shutting down", logging.KeyError, verr)
+					} else if verr != nil {
+						// the group didn't unblock, so fencing the other nodes could leave us with no working members at all
+						failRecovery(logger, &seedNode, decisionID, verr)
 					} else {
 						// We successfully unblocked the group, now let's try and politely STONITH the nodes in the losing partition
-						for _, member := range members {
-							if member.MemberState == "SHOOT_ME" {
-								err = member.Shutdown()
+						logger.Info("The forced primary partition is ONLINE with a quorum", "force_members", forceMemberString)
+						auditor.justify(decisionID, "Fencing the nodes left out of the forced primary partition", newSnapshot(loopNum, seedNode, false, members))
+
+						for i := range decision.Losing {
+							health.heartbeat()
+							member := &decision.Losing[i]
+
+							// the new primary partition has to be able to carry on without the node
+							if gerr := decision.Unfenced[i]; gerr != nil {
+								refuseAction(logger, member, decisionID, gerr)
+								continue
+							}
+
+							if !allowAction(logger, actionShutdown, seedNode.GroupName, member, decisionID) {
+								continue
 							}
 
-							if err != nil {
-								InfoLog.Printf("Could not shutdown node: '%s:%s'\n", member.MySQLHost, member.MySQLPort)
+							serr := member.Shutdown()
+							events.Publish(actionEvent(notify.EventNodeShutdown, member, decisionID, "Shut down the node left out of the forced primary partition", serr))
+
+							if serr != nil {
+								nodeLogger(logger, member).Error("Could not shutdown node", logging.KeyError, serr)
 							}
 						}
 					}
-				} else {
-					InfoLog.Println("No valid group membership to force!")
 				}
 			}
 		}
@@ -446,12 +876,80 @@ func MonitorCluster(seedNode group.Node) error {
 		lastView = make([]group.Node, len(members))
 		copy(lastView, members)
 
+		// and persist it, so that we can still find the cluster if we're restarted while the seed node is down
+		if serr := saveState(stateFile, savedState{Loop: loopNum, Cluster: seedNode.GroupName, Seed: seedNode, SeedQuorum: seedNode.Quorum, View: lastView, Breaker: breakerState()}); serr != nil {
+			if serr.Error() != lastStateErr {
+				logger.Error("Could not save the state file", "file", stateFile, logging.KeyError, serr)
+			}
+			lastStateErr = serr.Error()
+		} else {
+			lastStateErr = ""
+		}
+
+		// let's close the connections to any nodes that we haven't talked to in a while, e.g. ones that left the group
+		if evicted := group.DefaultPool.EvictIdle(); evicted > 0 {
+			logger.Info("Released the connections to idle nodes", "nodes", evicted)
+		}
+
+		// every action for this loop's decisions has now been carried out
+		auditor.settle()
+
+		// we can't keep making changes to the cluster that we can no longer account for
+		if aerr := auditor.failure(); aerr != nil {
+			return fmt.Errorf("The audit log can no longer be written: %v", aerr)
+		}
+
 		// let's force garbage collection while we sleep
 		go runtime.GC()
-		time.Sleep(time.Millisecond * 2000)
+		sleepContext(ctx, loopInterval)
+	}
+
+	Log.Info("Stopped monitoring the cluster")
+
+	return nil
+}
+
+// nodeLogger adds the fields that identify the node to the logger
+func nodeLogger(logger *slog.Logger, node *group.Node) *slog.Logger {
+	return logger.With(logging.KeyNode, node.MySQLHost+":"+node.MySQLPort, logging.KeyServerUUID, node.ServerUuid)
+}
+
+// nodeEvent builds a notification about the node
+func nodeEvent(evType string, severity string, node *group.Node, decisionID string, message string) notify.Event {
+	return notify.Event{
+		Type:       evType,
+		Severity:   severity,
+		Cluster:    node.GroupName,
+		Node:       node.MySQLHost + ":" + node.MySQLPort,
+		DecisionID: decisionID,
+		Message:    message,
+		Details:    map[string]interface{}{"server_uuid": node.ServerUuid},
+	}
+}
+
+// actionEvent builds a notification about an action that we took on the node, and its result
+func actionEvent(evType string, node *group.Node, decisionID string, message string, result error) notify.Event {
+	ev := nodeEvent(evType, notify.SeverityCritical, node, decisionID, message)
+	ev.Details["result"] = "OK"
+
+	if result != nil {
+		ev.Severity = notify.SeverityError
+		ev.Message = "FAILED: " + message
+		ev.Details["result"] = result.Error()
+	}
+
+	return ev
+}
+
+// newDecisionID returns a unique ID used to tie together everything that we log about a decision and its actions
+func newDecisionID() string {
+	id := make([]byte, 8)
+
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
 	}
 
-	return err
+	return hex.EncodeToString(id)
 }
 
 // The remaining functions are used to sort our membership slice
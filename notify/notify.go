@@ -0,0 +1,447 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package notify tells the outside world about what the arbitrator has seen and done. Events are published to a
+Dispatcher, which delivers them in the background to each Notifier subscribed to that type of event.
+*/
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattlord/myarbitratord/logging"
+)
+
+// The types of events that we publish
+const (
+	EventPartition     = "partition"
+	EventQuorumLoss    = "quorum_loss"
+	EventForceMembers  = "force_members"
+	EventNodeShutdown  = "node_shutdown"
+	EventReadOnly      = "read_only"
+	EventArbitratorErr = "arbitrator_error"
+	// EventMetadataMismatch is when the InnoDB Cluster metadata doesn't match the group membership
+	EventMetadataMismatch = "metadata_mismatch"
+	// EventReplicationLag is when a member's replication lag crosses one of the thresholds
+	EventReplicationLag = "replication_lag"
+	// EventMemberEjected is when a persistently lagging member is removed from the group
+	EventMemberEjected = "member_ejected"
+	// EventActionRefused is when we didn't shut down a node or force the membership, as it would have left too few ONLINE members
+	EventActionRefused = "action_refused"
+	// EventCircuitBreaker is when the action budget is used up and we're advisory-only, or when that's been reset
+	EventCircuitBreaker = "circuit_breaker"
+	// EventForceApproval is when forcing the membership is awaiting an operator's approval
+	EventForceApproval = "force_approval"
+	// EventForceAborted is when the membership isn't forced after all, as it couldn't be confirmed or it's no longer needed
+	EventForceAborted = "force_aborted"
+	// EventRecoveryFailed is when the forced membership didn't unblock the group, or when the group has since recovered
+	EventRecoveryFailed = "recovery_failed"
+)
+
+// The event severities, from least to most severe
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityError    = "error"
+	SeverityCritical = "critical"
+)
+
+// Event is something that happened which someone may need to know about
+type Event struct {
+	Type       string                 `json:"type"`
+	Severity   string                 `json:"severity"`
+	Time       time.Time              `json:"time"`
+	Cluster    string                 `json:"cluster,omitempty"`
+	Node       string                 `json:"node,omitempty"`
+	DecisionID string                 `json:"decision_id,omitempty"`
+	Message    string                 `json:"message"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	// Incident identifies the condition being reported, the decision and event type when it's empty
+	Incident string `json:"incident,omitempty"`
+	// Resolved is set when the condition reported by the earlier events with the same Incident has cleared
+	Resolved bool `json:"resolved,omitempty"`
+}
+
+// IncidentKey is what ties the events about the same condition together, e.g. to resolve an alert
+func (ev Event) IncidentKey() string {
+	if ev.Incident != "" {
+		return ev.Incident
+	}
+
+	// each type of event in a decision, e.g. the partition and the forced membership, is its own incident
+	if ev.DecisionID != "" {
+		return ev.DecisionID + ":" + ev.Type
+	}
+
+	return ev.Type + ":" + ev.Cluster + ":" + ev.Node
+}
+
+// Notifier delivers events to one destination
+type Notifier interface {
+	Name() string
+	Notify(ev Event) error
+}
+
+// DeadLetterer is a Notifier that keeps the events which were never delivered, e.g. in a dead letter file
+type DeadLetterer interface {
+	DeadLetter(ev Event, cause error) error
+}
+
+// Stopper is a Notifier whose retries can be cut short, which the dispatcher does when it runs out of time to close
+type Stopper interface {
+	Stop()
+}
+
+type subscription struct {
+	notifier Notifier
+	// the event types that the notifier wants, all of them when empty
+	types map[string]bool
+	// each notifier has its own queue, so that one that's slow or retrying doesn't hold up the others
+	queue chan Event
+}
+
+/*
+Dispatcher queues the published events and delivers them to the subscribed notifiers in the background, each
+notifier getting its own queue and goroutine.
+*/
+type Dispatcher struct {
+	Log *slog.Logger
+
+	mu        sync.RWMutex
+	subs      []*subscription
+	queueSize int
+	wg        sync.WaitGroup
+	closed    bool
+}
+
+// NewDispatcher returns a dispatcher which can queue up to queueSize events per notifier before it starts dropping them
+func NewDispatcher(queueSize int, logger *slog.Logger) *Dispatcher {
+	return &Dispatcher{Log: logger, queueSize: queueSize}
+}
+
+// Subscribe adds a notifier for the given event types, or for all events when no types are given
+func (d *Dispatcher) Subscribe(n Notifier, types []string) {
+	sub := &subscription{notifier: n, types: make(map[string]bool), queue: make(chan Event, d.queueSize)}
+
+	for _, t := range types {
+		sub.types[t] = true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	d.subs = append(d.subs, sub)
+	d.wg.Add(1)
+
+	go d.deliver(sub)
+}
+
+// Publish queues the event for delivery, it never blocks the caller
+func (d *Dispatcher) Publish(ev Event) {
+	if d == nil {
+		return
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return
+	}
+
+	for _, sub := range d.subs {
+		if len(sub.types) > 0 && !sub.types[ev.Type] {
+			continue
+		}
+
+		select {
+		case sub.queue <- ev:
+		default:
+			d.Log.Error("The event queue is full, dropping the event", "notifier", sub.notifier.Name(), "event_type", ev.Type, logging.KeyNode, ev.Node, logging.KeyDecisionID, ev.DecisionID)
+			d.deadLetter(sub, ev, errQueueFull)
+		}
+	}
+}
+
+// deliver sends each event queued for the notifier, until its queue is closed
+func (d *Dispatcher) deliver(sub *subscription) {
+	defer d.wg.Done()
+
+	for ev := range sub.queue {
+		if err := sub.notifier.Notify(ev); err != nil {
+			d.Log.Error("Could not deliver the event", "notifier", sub.notifier.Name(), "event_type", ev.Type, logging.KeyDecisionID, ev.DecisionID, logging.KeyError, err)
+		}
+	}
+}
+
+/*
+Close stops accepting events and waits up to the timeout for the queued ones to be delivered. If it runs out of time,
+the events still queued are dead-lettered and the notifiers stop retrying, so an event that's being retried is
+dead-lettered too.
+*/
+func (d *Dispatcher) Close(timeout time.Duration) error {
+	if d == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+
+		for _, sub := range d.subs {
+			close(sub.queue)
+		}
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	// the queues are closed, so we can take what's left in them before stopping any retries in progress
+	queued := 0
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, sub := range d.subs {
+		for ev := range sub.queue {
+			d.deadLetter(sub, ev, errShutdown)
+			queued++
+		}
+
+		if s, ok := sub.notifier.(Stopper); ok {
+			s.Stop()
+		}
+	}
+
+	return fmt.Errorf("Timed out after %v waiting for the queued events to be delivered, %d event(s) were not sent", timeout, queued)
+}
+
+// the causes recorded for the events that a notifier never got to try and deliver
+var (
+	errQueueFull = errors.New("the event queue was full")
+	errShutdown  = errors.New("shutting down before the event could be delivered")
+)
+
+// deadLetter hands an event that was never sent over to the notifier, if it keeps those
+func (d *Dispatcher) deadLetter(sub *subscription, ev Event, cause error) {
+	dl, ok := sub.notifier.(DeadLetterer)
+
+	if !ok {
+		return
+	}
+
+	if err := dl.DeadLetter(ev, cause); err != nil {
+		d.Log.Error("Could not write the event to the dead letter file", "notifier", sub.notifier.Name(), "event_type", ev.Type, logging.KeyDecisionID, ev.DecisionID, logging.KeyError, err)
+	}
+}
+
+// Config is the JSON encoded notification config file
+type Config struct {
+	Webhooks []WebhookConfig `json:"webhooks"`
+	SMTP     []SMTPConfig    `json:"smtp"`
+}
+
+// LoadConfig reads the notification config file
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+
+	contents, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return cfg, errors.New("Could not read the notification config from specified file: " + path)
+	}
+
+	if err = json.Unmarshal(contents, &cfg); err != nil {
+		return cfg, fmt.Errorf("Failed to parse the notification config in %s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Setup creates the notifiers from the config and subscribes them to the dispatcher
+func (d *Dispatcher) Setup(cfg Config) error {
+	for i, whc := range cfg.Webhooks {
+		wh, err := NewWebhook(whc, d.Log)
+
+		if err != nil {
+			return fmt.Errorf("webhook %d: %v", i, err)
+		}
+
+		d.Subscribe(wh, whc.Events)
+	}
+
+	for i, sc := range cfg.SMTP {
+		s, err := NewSMTP(sc, d.Log)
+
+		if err != nil {
+			return fmt.Errorf("smtp %d: %v", i, err)
+		}
+
+		events := sc.Events
+
+		if len(events) == 0 {
+			events = DefaultEmailEvents
+		}
+
+		d.Subscribe(s, events)
+	}
+
+	return nil
+}
+
+// retryPolicy retries a delivery with the backoff doubling after each failed attempt, up to the max
+type retryPolicy struct {
+	maxRetries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// closed by stop, which ends the backoff and any further retries
+	stopped  chan struct{}
+	stopOnce *sync.Once
+}
+
+// newRetryPolicy parses the retry settings from a notifier's config, using a 1s backoff capped at 1m by default
+func newRetryPolicy(maxRetries int, backoff string, maxBackoff string) (retryPolicy, error) {
+	var err error
+	p := retryPolicy{maxRetries: maxRetries, backoff: time.Second, maxBackoff: time.Minute, stopped: make(chan struct{}), stopOnce: &sync.Once{}}
+
+	if p.maxRetries < 0 {
+		p.maxRetries = 0
+	}
+
+	if backoff != "" {
+		if p.backoff, err = time.ParseDuration(backoff); err != nil {
+			return p, err
+		}
+	}
+
+	if maxBackoff != "" {
+		if p.maxBackoff, err = time.ParseDuration(maxBackoff); err != nil {
+			return p, err
+		}
+	}
+
+	return p, nil
+}
+
+// stop gives up on the retries, the current attempt still gets to finish
+func (p retryPolicy) stop() {
+	p.stopOnce.Do(func() { close(p.stopped) })
+}
+
+// do calls send until it succeeds, it fails with a permanentError, we run out of retries, or we're stopped
+func (p retryPolicy) do(logger *slog.Logger, notifier string, ev Event, send func() error) error {
+	backoff := p.backoff
+
+	for attempt := 0; ; attempt++ {
+		err := send()
+
+		if err == nil {
+			return nil
+		}
+
+		if _, ok := err.(permanentError); ok || attempt >= p.maxRetries {
+			return err
+		}
+
+		logger.Warn("Notification delivery failed, retrying", "notifier", notifier, "event_type", ev.Type, "attempt", attempt+1, "backoff", backoff, logging.KeyError, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-p.stopped:
+			return fmt.Errorf("gave up retrying when shutting down: %v", err)
+		}
+
+		if backoff *= 2; backoff > p.maxBackoff {
+			backoff = p.maxBackoff
+		}
+	}
+}
+
+// permanentError is a failure that retrying won't fix, e.g. the receiver rejected the payload
+type permanentError struct {
+	error
+}
+
+// hostname identifies the arbitrator in the notifications
+func hostname() (string, error) {
+	name, err := os.Hostname()
+
+	if err != nil {
+		name = "myarbitratord"
+	}
+
+	return name, err
+}
+
+// deadLetter appends an event that we gave up trying to deliver to the file, so that it's not lost
+func deadLetter(path string, notifier string, ev Event, cause error) error {
+	// the event was delivered after all
+	if path == "" || cause == nil {
+		return nil
+	}
+
+	entry := struct {
+		Time     time.Time `json:"time"`
+		Notifier string    `json:"notifier"`
+		Error    string    `json:"error"`
+		Event    Event     `json:"event"`
+	}{time.Now(), notifier, cause.Error(), ev}
+
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+
+	return err
+}
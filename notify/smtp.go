@@ -0,0 +1,392 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/mattlord/myarbitratord/credentials"
+	"github.com/mattlord/myarbitratord/logging"
+)
+
+// The ways that we can secure the connection to the SMTP server
+const (
+	// SMTPStartTLS requires the server to support STARTTLS, so the credentials and alerts are never sent in the clear
+	SMTPStartTLS = "starttls"
+	// SMTPImplicitTLS connects using TLS from the start, typically to port 465
+	SMTPImplicitTLS = "tls"
+	// SMTPNoTLS is only meant for a local relay or test sink
+	SMTPNoTLS = "none"
+)
+
+// DefaultEmailEvents are the event types sent by email when none are specified, the ones that need someone to act
+var DefaultEmailEvents = []string{EventQuorumLoss, EventForceMembers, EventNodeShutdown, EventArbitratorErr, EventActionRefused, EventCircuitBreaker, EventForceApproval, EventRecoveryFailed}
+
+// The default message templates, they're rendered with the event's fields along with .Summary, .Arbitrator and
+// .Suppressed (the number of emails not sent since the last one because of the rate limit)
+const (
+	DefaultEmailSubject = `[myarbitratord] {{upper .Severity}} {{.Type}}{{if .Cluster}} in {{.Cluster}}{{end}}{{if .Node}} on {{.Node}}{{end}}`
+	DefaultEmailBody    = `{{.Message}}
+
+Event:       {{.Type}}
+Severity:    {{.Severity}}
+Time:        {{.Time.Format "2006-01-02 15:04:05 MST"}}
+{{- if .Cluster}}
+Cluster:     {{.Cluster}}{{end}}
+{{- if .Node}}
+Node:        {{.Node}}{{end}}
+{{- if .DecisionID}}
+Decision ID: {{.DecisionID}}{{end}}
+{{- range $key, $val := .Details}}
+{{$key}}: {{$val}}{{end}}
+{{if .Suppressed}}
+{{.Suppressed}} earlier notification(s) were not emailed because of the rate limit, see the arbitrator's log for them.
+{{end}}
+--
+Sent by myarbitratord on {{.Arbitrator}}
+`
+)
+
+// SMTPConfig is the email notifier in the notification config file
+type SMTPConfig struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	// Port defaults to 587, or 465 when using implicit TLS
+	Port int `json:"port"`
+	// TLS is one of starttls (the default), tls or none
+	TLS                string `json:"tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// Username and Password are used for SMTP AUTH PLAIN, the password can instead be read from the PasswordFile
+	Username     string   `json:"username"`
+	Password     string   `json:"password"`
+	PasswordFile string   `json:"password_file"`
+	From         string   `json:"from"`
+	To           []string `json:"to"`
+	// Events are the event types to send, DefaultEmailEvents when empty
+	Events []string `json:"events"`
+	// Subject and Body are text/template templates, overriding the defaults
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	// at most RateLimit emails are sent within any RateWindow, the rest are only logged
+	RateLimit  int    `json:"rate_limit"`
+	RateWindow string `json:"rate_window"`
+	// the retry policy, just as with the webhooks
+	MaxRetries int    `json:"max_retries"`
+	Backoff    string `json:"backoff"`
+	MaxBackoff string `json:"max_backoff"`
+	Timeout    string `json:"timeout"`
+	// DeadLetterFile is where the events are written when we give up trying to deliver them
+	DeadLetterFile string `json:"dead_letter_file"`
+}
+
+// SMTP emails each event
+type SMTP struct {
+	cfg     SMTPConfig
+	addr    string
+	subject *template.Template
+	body    *template.Template
+	retry   retryPolicy
+	timeout time.Duration
+	log     *slog.Logger
+
+	// the rate limiter, the times that we sent the emails within the current window
+	mu         sync.Mutex
+	window     time.Duration
+	sent       []time.Time
+	suppressed int
+}
+
+// emailData is what the templates are rendered with
+type emailData struct {
+	Event
+	Summary    string
+	Arbitrator string
+	Suppressed int
+}
+
+func NewSMTP(cfg SMTPConfig, logger *slog.Logger) (*SMTP, error) {
+	var err error
+	s := &SMTP{cfg: cfg, timeout: 10 * time.Second, window: time.Hour, log: logger}
+
+	if s.cfg.Host == "" {
+		return nil, errors.New("no host specified")
+	}
+
+	if s.cfg.From == "" || len(s.cfg.To) == 0 {
+		return nil, errors.New("both from and to must be specified")
+	}
+
+	if s.cfg.TLS == "" {
+		s.cfg.TLS = SMTPStartTLS
+	}
+
+	switch s.cfg.TLS {
+	case SMTPStartTLS, SMTPNoTLS:
+		if s.cfg.Port == 0 {
+			s.cfg.Port = 587
+		}
+	case SMTPImplicitTLS:
+		if s.cfg.Port == 0 {
+			s.cfg.Port = 465
+		}
+	default:
+		return nil, errors.New("unknown tls mode '" + s.cfg.TLS + "', the supported modes are: starttls, tls, none")
+	}
+
+	s.addr = net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+
+	if s.cfg.Name == "" {
+		s.cfg.Name = "email " + strings.Join(s.cfg.To, ",")
+	}
+
+	if s.cfg.PasswordFile != "" && s.cfg.Password == "" {
+		if s.cfg.Password, err = credentials.ReadSecretFile(s.cfg.PasswordFile); err != nil {
+			return nil, errors.New("Could not read the secret from specified file: " + s.cfg.PasswordFile)
+		}
+	}
+
+	if s.cfg.Subject == "" {
+		s.cfg.Subject = DefaultEmailSubject
+	}
+
+	if s.cfg.Body == "" {
+		s.cfg.Body = DefaultEmailBody
+	}
+
+	funcs := template.FuncMap{"upper": strings.ToUpper}
+
+	if s.subject, err = template.New("subject").Funcs(funcs).Parse(s.cfg.Subject); err != nil {
+		return nil, err
+	}
+
+	if s.body, err = template.New("body").Funcs(funcs).Parse(s.cfg.Body); err != nil {
+		return nil, err
+	}
+
+	if s.cfg.RateLimit <= 0 {
+		s.cfg.RateLimit = 10
+	}
+
+	if s.cfg.RateWindow != "" {
+		if s.window, err = time.ParseDuration(s.cfg.RateWindow); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.retry, err = newRetryPolicy(cfg.MaxRetries, cfg.Backoff, cfg.MaxBackoff); err != nil {
+		return nil, err
+	}
+
+	if cfg.Timeout != "" {
+		if s.timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *SMTP) Name() string {
+	return s.cfg.Name
+}
+
+// DeadLetter appends an event that wasn't delivered to the dead letter file, if there is one
+func (s *SMTP) DeadLetter(ev Event, cause error) error {
+	return deadLetter(s.cfg.DeadLetterFile, s.cfg.Name, ev, cause)
+}
+
+// Stop gives up on any retries, so that we can shut down
+func (s *SMTP) Stop() {
+	s.retry.stop()
+}
+
+// Notify emails the event, unless we've hit the rate limit, dead-lettering it if we have to give up
+func (s *SMTP) Notify(ev Event) error {
+	suppressed, ok := s.allow()
+
+	if !ok {
+		s.log.Warn("Email rate limit reached, not sending the notification", "notifier", s.cfg.Name, "event_type", ev.Type, logging.KeyDecisionID, ev.DecisionID, "rate_limit", s.cfg.RateLimit, "rate_window", s.window)
+		return nil
+	}
+
+	msg, err := s.message(ev, suppressed)
+
+	if err == nil {
+		err = s.retry.do(s.log, s.cfg.Name, ev, func() error {
+			return s.send(msg)
+		})
+	}
+
+	if err != nil {
+		if dlerr := s.DeadLetter(ev, err); dlerr != nil {
+			s.log.Error("Could not write the event to the dead letter file", "notifier", s.cfg.Name, "file", s.cfg.DeadLetterFile, logging.KeyError, dlerr)
+		}
+	}
+
+	return err
+}
+
+// allow applies the rate limit, returning how many emails were suppressed since the last one that was allowed
+func (s *SMTP) allow() (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	recent := s.sent[:0]
+
+	for _, t := range s.sent {
+		if now.Sub(t) < s.window {
+			recent = append(recent, t)
+		}
+	}
+
+	s.sent = recent
+
+	if len(s.sent) >= s.cfg.RateLimit {
+		s.suppressed++
+		return s.suppressed, false
+	}
+
+	s.sent = append(s.sent, now)
+	suppressed := s.suppressed
+	s.suppressed = 0
+
+	return suppressed, true
+}
+
+// message renders the complete RFC 5322 message for the event
+func (s *SMTP) message(ev Event, suppressed int) ([]byte, error) {
+	var subject, body, msg bytes.Buffer
+
+	arbitrator, _ := hostname()
+	data := emailData{Event: ev, Summary: Summary(ev), Arbitrator: arbitrator, Suppressed: suppressed}
+
+	if err := s.subject.Execute(&subject, data); err != nil {
+		return nil, permanentError{err}
+	}
+
+	if err := s.body.Execute(&body, data); err != nil {
+		return nil, permanentError{err}
+	}
+
+	// a header can't span lines, so let's not allow a template or event to inject any more headers
+	subj := strings.Join(strings.Fields(subject.String()), " ")
+
+	fmt.Fprintf(&msg, "From: %s\r\n", s.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subj))
+	fmt.Fprintf(&msg, "Date: %s\r\n", ev.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%d.%s@%s>\r\n", ev.Time.UnixNano(), ev.Type, arbitrator)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.Replace(strings.Replace(body.String(), "\r\n", "\n", -1), "\n", "\r\n", -1))
+
+	return msg.Bytes(), nil
+}
+
+// send delivers the message over a new connection to the SMTP server
+func (s *SMTP) send(msg []byte) error {
+	var conn net.Conn
+	var err error
+
+	tlsConfig := &tls.Config{ServerName: s.cfg.Host, InsecureSkipVerify: s.cfg.InsecureSkipVerify}
+	dialer := &net.Dialer{Timeout: s.timeout}
+
+	if s.cfg.TLS == SMTPImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// bound the whole conversation, so that a hung server can't stall the delivery of the other notifications
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	client, err := smtp.NewClient(conn, s.cfg.Host)
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	defer client.Close()
+
+	if arbitrator, herr := hostname(); herr == nil {
+		if err = client.Hello(arbitrator); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.TLS == SMTPStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return permanentError{errors.New(s.addr + " does not support STARTTLS, use \"tls\": \"none\" if that's really OK")}
+		}
+
+		if err = client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(s.cfg.From); err != nil {
+		return err
+	}
+
+	for _, to := range s.cfg.To {
+		if err = client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	wc, err := client.Data()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = wc.Write(msg); err != nil {
+		wc.Close()
+		return err
+	}
+
+	if err = wc.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
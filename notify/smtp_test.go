@@ -0,0 +1,230 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package notify
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// smtpSink is a local SMTP server that accepts every message, without STARTTLS, keeping what it was sent
+type smtpSink struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &smtpSink{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go sink.serve(conn)
+		}
+	}()
+
+	return sink
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+
+	in := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 sink ESMTP")
+
+	for {
+		line, err := in.ReadString('\n')
+
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 sink")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 go ahead")
+
+			var msg strings.Builder
+
+			for {
+				data, err := in.ReadString('\n')
+
+				if err != nil {
+					return
+				}
+
+				if data == ".\r\n" {
+					break
+				}
+
+				msg.WriteString(data)
+			}
+
+			s.mu.Lock()
+			s.messages = append(s.messages, msg.String())
+			s.mu.Unlock()
+
+			reply("250 queued")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *smtpSink) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.messages...)
+}
+
+func (s *smtpSink) hostPort() (string, int) {
+	addr := s.listener.Addr().(*net.TCPAddr)
+
+	return addr.IP.String(), addr.Port
+}
+
+func TestSMTPDelivers(t *testing.T) {
+	sink := newSMTPSink(t)
+	host, port := sink.hostPort()
+
+	s, err := NewSMTP(SMTPConfig{Host: host, Port: port, TLS: SMTPNoTLS, From: "arbitrator@example.com", To: []string{"oncall@example.com"}}, testLog)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Notify(testEvent(EventQuorumLoss)); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	msgs := sink.received()
+
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+
+	for _, want := range []string{"To: oncall@example.com", "quorum_loss", "Decision ID: d1"} {
+		if !strings.Contains(msgs[0], want) {
+			t.Errorf("the message doesn't contain %q:\n%s", want, msgs[0])
+		}
+	}
+}
+
+func TestSMTPRequiresStartTLS(t *testing.T) {
+	sink := newSMTPSink(t)
+	host, port := sink.hostPort()
+	deadLetters := filepath.Join(t.TempDir(), "undelivered.ndjson")
+
+	s, err := NewSMTP(SMTPConfig{Host: host, Port: port, From: "arbitrator@example.com", To: []string{"oncall@example.com"}, MaxRetries: 3, Backoff: "1ms", DeadLetterFile: deadLetters}, testLog)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Notify(testEvent(EventQuorumLoss)); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("expected the lack of STARTTLS to fail the delivery, got: %v", err)
+	}
+
+	if n := len(sink.received()); n != 0 {
+		t.Errorf("expected nothing to be sent in the clear, got %d message(s)", n)
+	}
+
+	if contents, _ := ioutil.ReadFile(deadLetters); !strings.Contains(string(contents), `"quorum_loss"`) {
+		t.Errorf("expected the event to be dead-lettered, got: %s", contents)
+	}
+}
+
+func TestSMTPRateLimit(t *testing.T) {
+	sink := newSMTPSink(t)
+	host, port := sink.hostPort()
+
+	s, err := NewSMTP(SMTPConfig{Host: host, Port: port, TLS: SMTPNoTLS, From: "arbitrator@example.com", To: []string{"oncall@example.com"}, RateLimit: 2, RateWindow: "1h"}, testLog)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err = s.Notify(testEvent(EventNodeShutdown)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(sink.received()); n != 2 {
+		t.Errorf("expected the rate limit to allow 2 messages, got %d", n)
+	}
+}
+
+func TestDeadLetterOnlyOnFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		statuses []int
+		wantDead bool
+	}{
+		{"delivered", []int{200}, false},
+		{"rejected", []int{400}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := newWebhookServer(t, tt.statuses...)
+			deadLetters := filepath.Join(dir, tt.name+".ndjson")
+			wh, err := NewWebhook(WebhookConfig{URL: ws.URL, DeadLetterFile: deadLetters}, testLog)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wh.Notify(testEvent(EventForceMembers))
+
+			contents, _ := ioutil.ReadFile(deadLetters)
+
+			if dead := len(contents) > 0; dead != tt.wantDead {
+				t.Errorf("expected the event to be dead-lettered: %t, the dead letter file has: %s", tt.wantDead, contents)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattlord/myarbitratord/logging"
+)
+
+// The webhook payload formats
+const (
+	FormatGeneric   = "generic"
+	FormatSlack     = "slack"
+	FormatPagerDuty = "pagerduty"
+)
+
+// the PagerDuty Events API v2 endpoint, used when no URL is specified for a pagerduty webhook
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// WebhookConfig is one webhook in the notification config file
+type WebhookConfig struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Format string `json:"format"`
+	// Events are the event types to send, all of them when empty
+	Events  []string          `json:"events"`
+	Headers map[string]string `json:"headers"`
+	// RoutingKey is the PagerDuty integration key
+	RoutingKey string `json:"routing_key"`
+	// the retry policy, with the backoff doubling after each failed attempt up to the max
+	MaxRetries int    `json:"max_retries"`
+	Backoff    string `json:"backoff"`
+	MaxBackoff string `json:"max_backoff"`
+	Timeout    string `json:"timeout"`
+	// DeadLetterFile is where the events are written when we give up trying to deliver them
+	DeadLetterFile string `json:"dead_letter_file"`
+}
+
+// Webhook POSTs each event as JSON to a URL
+type Webhook struct {
+	cfg    WebhookConfig
+	retry  retryPolicy
+	client *http.Client
+	log    *slog.Logger
+}
+
+func NewWebhook(cfg WebhookConfig, logger *slog.Logger) (*Webhook, error) {
+	var err error
+	wh := &Webhook{cfg: cfg, log: logger}
+	timeout := 10 * time.Second
+
+	if wh.cfg.Format == "" {
+		wh.cfg.Format = FormatGeneric
+	}
+
+	switch wh.cfg.Format {
+	case FormatGeneric, FormatSlack:
+	case FormatPagerDuty:
+		if wh.cfg.RoutingKey == "" {
+			return nil, errors.New("a routing_key is required for the pagerduty format")
+		}
+
+		if wh.cfg.URL == "" {
+			wh.cfg.URL = pagerDutyEventsURL
+		}
+	default:
+		return nil, errors.New("unknown format '" + wh.cfg.Format + "', the supported formats are: generic, slack, pagerduty")
+	}
+
+	if wh.cfg.URL == "" {
+		return nil, errors.New("no url specified")
+	}
+
+	if wh.cfg.Name == "" {
+		wh.cfg.Name = wh.cfg.Format + " webhook " + wh.cfg.URL
+	}
+
+	if wh.retry, err = newRetryPolicy(cfg.MaxRetries, cfg.Backoff, cfg.MaxBackoff); err != nil {
+		return nil, err
+	}
+
+	if cfg.Timeout != "" {
+		if timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	wh.client = &http.Client{Timeout: timeout}
+
+	return wh, nil
+}
+
+func (wh *Webhook) Name() string {
+	return wh.cfg.Name
+}
+
+// DeadLetter appends an event that wasn't delivered to the dead letter file, if there is one
+func (wh *Webhook) DeadLetter(ev Event, cause error) error {
+	return deadLetter(wh.cfg.DeadLetterFile, wh.cfg.Name, ev, cause)
+}
+
+// Stop gives up on any retries, so that we can shut down
+func (wh *Webhook) Stop() {
+	wh.retry.stop()
+}
+
+// Notify delivers the event, retrying with an exponential backoff, and dead-lettering it if we have to give up
+func (wh *Webhook) Notify(ev Event) error {
+	payload, err := wh.payload(ev)
+
+	if err == nil {
+		err = wh.retry.do(wh.log, wh.cfg.Name, ev, func() error {
+			return wh.post(payload)
+		})
+	}
+
+	if err != nil {
+		if dlerr := wh.DeadLetter(ev, err); dlerr != nil {
+			wh.log.Error("Could not write the event to the dead letter file", "notifier", wh.cfg.Name, "file", wh.cfg.DeadLetterFile, logging.KeyError, dlerr)
+		}
+	}
+
+	return err
+}
+
+func (wh *Webhook) post(payload []byte) error {
+	req, err := http.NewRequest("POST", wh.cfg.URL, bytes.NewReader(payload))
+
+	if err != nil {
+		return permanentError{err}
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for k, v := range wh.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := wh.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	err = fmt.Errorf("%s responded with %s: %s", wh.cfg.URL, resp.Status, strings.TrimSpace(string(body)))
+
+	// the server may be able to handle it later, but anything else in the 4xx range is our problem
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout {
+		return err
+	}
+
+	return permanentError{err}
+}
+
+// payload renders the event in the webhook's format
+func (wh *Webhook) payload(ev Event) ([]byte, error) {
+	switch wh.cfg.Format {
+	case FormatSlack:
+		return json.Marshal(map[string]string{"text": Summary(ev)})
+	case FormatPagerDuty:
+		return json.Marshal(pagerDutyEvent(ev, wh.cfg.RoutingKey))
+	}
+
+	return json.Marshal(ev)
+}
+
+// Summary is a one line, human readable, description of the event
+func Summary(ev Event) string {
+	summary := "[" + strings.ToUpper(ev.Severity) + "] " + ev.Type
+
+	if ev.Cluster != "" {
+		summary += " in cluster " + ev.Cluster
+	}
+
+	if ev.Node != "" {
+		summary += " on " + ev.Node
+	}
+
+	return summary + ": " + ev.Message
+}
+
+// pagerDutyEvent builds a PagerDuty Events API v2 trigger, or the resolve for one when the condition has cleared
+func pagerDutyEvent(ev Event, routingKey string) interface{} {
+	type pdPayload struct {
+		Summary       string                 `json:"summary"`
+		Source        string                 `json:"source"`
+		Severity      string                 `json:"severity"`
+		Timestamp     string                 `json:"timestamp"`
+		Component     string                 `json:"component,omitempty"`
+		Group         string                 `json:"group,omitempty"`
+		Class         string                 `json:"class"`
+		CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+	}
+
+	type pdEvent struct {
+		RoutingKey  string     `json:"routing_key"`
+		EventAction string     `json:"event_action"`
+		DedupKey    string     `json:"dedup_key,omitempty"`
+		Payload     *pdPayload `json:"payload,omitempty"`
+	}
+
+	// a resolve only needs the dedup_key of the incident that it resolves
+	if ev.Resolved {
+		return pdEvent{RoutingKey: routingKey, EventAction: "resolve", DedupKey: ev.IncidentKey()}
+	}
+
+	// PagerDuty only accepts these severities
+	severity := ev.Severity
+
+	if severity != SeverityCritical && severity != SeverityError && severity != SeverityWarning {
+		severity = SeverityInfo
+	}
+
+	source, _ := hostname()
+
+	details := map[string]interface{}{"decision_id": ev.DecisionID}
+
+	for k, v := range ev.Details {
+		details[k] = v
+	}
+
+	return pdEvent{
+		RoutingKey:  routingKey,
+		EventAction: "trigger",
+		DedupKey:    ev.IncidentKey(),
+		Payload: &pdPayload{
+			Summary:       Summary(ev),
+			Source:        source,
+			Severity:      severity,
+			Timestamp:     ev.Time.Format(time.RFC3339),
+			Component:     ev.Node,
+			Group:         ev.Cluster,
+			Class:         ev.Type,
+			CustomDetails: details,
+		},
+	}
+}
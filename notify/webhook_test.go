@@ -0,0 +1,389 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// webhookServer is a local stand-in for a webhook receiver, responding with each of the statuses in turn
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	ws := &webhookServer{statuses: statuses}
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		ws.mu.Lock()
+		ws.bodies = append(ws.bodies, body)
+		status := http.StatusOK
+
+		if len(ws.statuses) > 0 {
+			status, ws.statuses = ws.statuses[0], ws.statuses[1:]
+		}
+		ws.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ws.Close)
+
+	return ws
+}
+
+func (ws *webhookServer) requests() [][]byte {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	return append([][]byte(nil), ws.bodies...)
+}
+
+func testEvent(eventType string) Event {
+	return Event{Type: eventType, Severity: SeverityCritical, Time: time.Now(), Cluster: "c1", Node: "hanode1:3306", DecisionID: "d1", Message: "test"}
+}
+
+func TestWebhookGeneric(t *testing.T) {
+	ws := newWebhookServer(t)
+	wh, err := NewWebhook(WebhookConfig{URL: ws.URL}, testLog)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = wh.Notify(testEvent(EventPartition)); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	reqs := ws.requests()
+
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+
+	var ev Event
+
+	if err = json.Unmarshal(reqs[0], &ev); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev.Type != EventPartition || ev.Cluster != "c1" || ev.DecisionID != "d1" {
+		t.Errorf("unexpected event delivered: %+v", ev)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+		wantReqs int
+	}{
+		{"recovers after server errors", []int{500, 503, 200}, false, 3},
+		{"gives up after max retries", []int{500, 500, 500, 500}, true, 3},
+		{"client error is permanent", []int{400}, true, 1},
+		{"too many requests is retried", []int{429, 200}, false, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := newWebhookServer(t, tt.statuses...)
+			wh, err := NewWebhook(WebhookConfig{URL: ws.URL, MaxRetries: 2, Backoff: "1ms"}, testLog)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = wh.Notify(testEvent(EventNodeShutdown))
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Notify returned %v, wanted an error: %t", err, tt.wantErr)
+			}
+
+			if n := len(ws.requests()); n != tt.wantReqs {
+				t.Errorf("expected %d request(s), got %d", tt.wantReqs, n)
+			}
+		})
+	}
+}
+
+func TestPagerDutyDedupKey(t *testing.T) {
+	ws := newWebhookServer(t)
+	wh, err := NewWebhook(WebhookConfig{URL: ws.URL, Format: FormatPagerDuty, RoutingKey: "key"}, testLog)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, eventType := range []string{EventPartition, EventForceMembers, EventNodeShutdown} {
+		if err = wh.Notify(testEvent(eventType)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := make(map[string]bool)
+
+	for _, body := range ws.requests() {
+		var pd struct {
+			DedupKey string `json:"dedup_key"`
+		}
+
+		if err = json.Unmarshal(body, &pd); err != nil {
+			t.Fatal(err)
+		}
+
+		keys[pd.DedupKey] = true
+	}
+
+	if len(keys) != 3 {
+		t.Errorf("expected each event type in the decision to have its own dedup_key, got %v", keys)
+	}
+}
+
+func TestPagerDutyResolve(t *testing.T) {
+	ws := newWebhookServer(t)
+	wh, err := NewWebhook(WebhookConfig{URL: ws.URL, Format: FormatPagerDuty, RoutingKey: "key"}, testLog)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an event that clears the condition may not know the decision which raised it, so they can share an incident instead
+	raised := testEvent(EventArbitratorErr)
+	raised.Incident = "arbitrator_error:c1"
+	cleared := Event{Type: EventArbitratorErr, Severity: SeverityInfo, Cluster: "c1", Message: "cleared", Incident: raised.Incident, Resolved: true}
+
+	lost := testEvent(EventQuorumLoss)
+	regained := Event{Type: EventQuorumLoss, Severity: SeverityInfo, Cluster: "c1", DecisionID: lost.DecisionID, Message: "regained", Resolved: true}
+
+	for _, ev := range []Event{raised, cleared, lost, regained} {
+		if err = wh.Notify(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type pdEvent struct {
+		EventAction string           `json:"event_action"`
+		DedupKey    string           `json:"dedup_key"`
+		Payload     *json.RawMessage `json:"payload"`
+	}
+
+	var sent []pdEvent
+
+	for _, body := range ws.requests() {
+		var pd pdEvent
+
+		if err = json.Unmarshal(body, &pd); err != nil {
+			t.Fatal(err)
+		}
+
+		sent = append(sent, pd)
+	}
+
+	if len(sent) != 4 {
+		t.Fatalf("expected 4 events, got %d", len(sent))
+	}
+
+	for i := 0; i < len(sent); i += 2 {
+		trigger, resolve := sent[i], sent[i+1]
+
+		if trigger.EventAction != "trigger" || resolve.EventAction != "resolve" || resolve.Payload != nil {
+			t.Errorf("expected a trigger and then a resolve without a payload, got %+v and %+v", trigger, resolve)
+		}
+
+		if trigger.DedupKey == "" || trigger.DedupKey != resolve.DedupKey {
+			t.Errorf("the resolve has the dedup_key %q, expected the trigger's %q", resolve.DedupKey, trigger.DedupKey)
+		}
+	}
+}
+
+// blockingNotifier never completes a delivery until it's released
+type blockingNotifier struct {
+	release chan struct{}
+}
+
+func (b *blockingNotifier) Name() string { return "blocking" }
+
+func (b *blockingNotifier) Notify(ev Event) error {
+	<-b.release
+	return nil
+}
+
+func TestDispatcherSlowNotifier(t *testing.T) {
+	ws := newWebhookServer(t)
+	wh, err := NewWebhook(WebhookConfig{URL: ws.URL}, testLog)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slow := &blockingNotifier{release: make(chan struct{})}
+	d := NewDispatcher(10, testLog)
+	d.Subscribe(slow, nil)
+	d.Subscribe(wh, nil)
+
+	d.Publish(testEvent(EventPartition))
+	d.Publish(testEvent(EventQuorumLoss))
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(ws.requests()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := len(ws.requests()); n != 2 {
+		t.Errorf("the webhook got %d event(s) while another notifier was stuck, expected 2", n)
+	}
+
+	close(slow.release)
+
+	if err = d.Close(5 * time.Second); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+// deadLetters reads the entries in a dead letter file, which may not exist yet
+func deadLetters(t *testing.T, path string) []deadLetterEntry {
+	var entries []deadLetterEntry
+
+	contents, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		var e deadLetterEntry
+
+		if err = json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad dead letter entry %q: %v", line, err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+type deadLetterEntry struct {
+	Error string `json:"error"`
+	Event Event  `json:"event"`
+}
+
+// stuckNotifier picks up an event and never gets to deliver it, dead-lettering what it's given
+type stuckNotifier struct {
+	blockingNotifier
+	started chan struct{}
+	mu      sync.Mutex
+	dead    map[string]string
+}
+
+func (s *stuckNotifier) Notify(ev Event) error {
+	s.started <- struct{}{}
+	return s.blockingNotifier.Notify(ev)
+}
+
+func (s *stuckNotifier) DeadLetter(ev Event, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dead[ev.Type] = cause.Error()
+
+	return nil
+}
+
+func TestDispatcherDeadLetter(t *testing.T) {
+	stuck := &stuckNotifier{blockingNotifier{make(chan struct{})}, make(chan struct{}, 1), sync.Mutex{}, map[string]string{}}
+	d := NewDispatcher(1, testLog)
+	d.Subscribe(stuck, nil)
+
+	// the first event is picked up, the second is queued, and the third doesn't fit
+	d.Publish(testEvent(EventPartition))
+	<-stuck.started
+	d.Publish(testEvent(EventQuorumLoss))
+	d.Publish(testEvent(EventForceMembers))
+
+	if err := d.Close(50 * time.Millisecond); err == nil || !strings.Contains(err.Error(), "1 event(s)") {
+		t.Errorf("expected Close to time out with 1 event not sent, got %v", err)
+	}
+
+	close(stuck.release)
+
+	stuck.mu.Lock()
+	defer stuck.mu.Unlock()
+
+	expected := map[string]string{EventQuorumLoss: errShutdown.Error(), EventForceMembers: errQueueFull.Error()}
+
+	if !reflect.DeepEqual(stuck.dead, expected) {
+		t.Errorf("dead-lettered %v, expected %v", stuck.dead, expected)
+	}
+}
+
+func TestDispatcherCloseStopsRetries(t *testing.T) {
+	ws := newWebhookServer(t, http.StatusServiceUnavailable)
+	dlf := filepath.Join(t.TempDir(), "dead.jsonl")
+	wh, err := NewWebhook(WebhookConfig{URL: ws.URL, MaxRetries: 5, Backoff: "1h", DeadLetterFile: dlf}, testLog)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDispatcher(10, testLog)
+	d.Subscribe(wh, nil)
+	d.Publish(testEvent(EventPartition))
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(ws.requests()) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err = d.Close(50 * time.Millisecond); err == nil {
+		t.Error("expected Close to time out while the webhook was backing off")
+	}
+
+	// the retry gives up instead of sleeping for an hour, and the event is kept
+	for len(deadLetters(t, dlf)) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	entries := deadLetters(t, dlf)
+
+	if len(entries) != 1 || entries[0].Event.Type != EventPartition || !strings.Contains(entries[0].Error, "shutting down") {
+		t.Errorf("expected the event being retried to be dead-lettered on shutdown, got %+v", entries)
+	}
+
+	if n := len(ws.requests()); n != 1 {
+		t.Errorf("the webhook was tried %d times, expected 1", n)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/notify"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// minOnlineMembers is the fewest ONLINE members that any fencing action may leave the group with
+var minOnlineMembers = 1
+
+// sameNode tells us if the two are the same member, by server UUID when we have it and otherwise by 'host:port'
+func sameNode(a group.Node, b group.Node) bool {
+	if a.ServerUuid != "" && b.ServerUuid != "" {
+		return a.ServerUuid == b.ServerUuid
+	}
+
+	return a.MySQLHost == b.MySQLHost && a.MySQLPort == b.MySQLPort
+}
+
+/*
+guardAction simulates the group membership once the removed nodes are gone, e.g. shut down or fenced, and returns an
+error explaining why the action must be refused: when it would leave fewer than -min-online-members ONLINE members,
+or when the remaining ONLINE members would no longer be a majority of the membership. It returns nil when it's safe.
+*/
+func guardAction(action string, view []group.Node, removed ...group.Node) error {
+	return guardMembership(action, view, minOnlineMembers, removed...)
+}
+
+// guardMembership is guardAction with the given minimum of ONLINE members
+func guardMembership(action string, view []group.Node, minOnline int, removed ...group.Node) error {
+	online := 0
+
+	for _, node := range view {
+		if node.MemberState != "ONLINE" {
+			continue
+		}
+
+		gone := false
+
+		for _, r := range removed {
+			if sameNode(node, r) {
+				gone = true
+				break
+			}
+		}
+
+		if !gone {
+			online++
+		}
+	}
+
+	if online < minOnline {
+		return fmt.Errorf("%s would leave %d ONLINE member(s), fewer than the minimum of %d", action, online, minOnline)
+	}
+
+	if online*2 <= len(view) {
+		return fmt.Errorf("%s would leave %d of the %d members ONLINE, which is not a majority", action, online, len(view))
+	}
+
+	return nil
+}
+
+// refuseAction logs and publishes that we did not act on the node, as the guard refused it
+func refuseAction(logger *slog.Logger, node *group.Node, decisionID string, reason error) {
+	nodeLogger(logger, node).Error("Refusing the fencing action, it's not safe", logging.KeyDecisionID, decisionID, "min_online_members", minOnlineMembers, logging.KeyError, reason)
+
+	ev := nodeEvent(notify.EventActionRefused, notify.SeverityCritical, node, decisionID, "Refused the fencing action: "+reason.Error())
+	ev.Details["min_online_members"] = minOnlineMembers
+	events.Publish(ev)
+}
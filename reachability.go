@@ -0,0 +1,433 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// the state shown in the matrix for a member that we couldn't ask about its view
+const notObserved = "-"
+
+/*
+reachabilityMatrix is each member's own view of the group, from replication_group_members, presented as JSON via the
+"/reachability" HTTP API call. States[i][j] is the state that Members[i] sees Members[j] in, which is "-" for a whole
+row when we couldn't ask that member, and empty when the member doesn't list the other one at all.
+*/
+type reachabilityMatrix struct {
+	Time       time.Time        `json:"Time"`
+	Members    []string         `json:"Members"`
+	States     [][]string       `json:"States"`
+	Partitions []reachPartition `json:"Partitions"`
+	// Isolated are the members that no one, including us, can currently see as ONLINE
+	Isolated []string `json:"Isolated,omitempty"`
+	// the members, in the same order as Members, and if we could ask each one
+	nodes    []group.Node
+	observed []bool
+}
+
+// reachPartition is a set of members that see each other as ONLINE
+type reachPartition struct {
+	Members []string `json:"Members"`
+	Quorum  bool     `json:"Quorum"`
+	// the indexes of the members in the matrix
+	index []int
+}
+
+// the latest matrix, for the "/reachability" HTTP API call
+var reachability = struct {
+	sync.RWMutex
+	latest *reachabilityMatrix
+}{}
+
+// buildReachability asks each member in the view, all at once, for its own view of the group and builds the matrix
+func buildReachability(view []group.Node) *reachabilityMatrix {
+	views := make([][]group.Node, len(view))
+	var wg sync.WaitGroup
+
+	for i := range view {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			member := view[i]
+			err := member.Connect()
+			noteConnectResult(&member, err)
+			defer member.Cleanup()
+
+			if err == nil {
+				if seen, err := member.GetMembers(); err == nil && len(seen) > 0 {
+					views[i] = seen
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	return newReachabilityMatrix(view, views)
+}
+
+// newReachabilityMatrix builds the matrix from each member's view of the group, nil for those we couldn't ask
+func newReachabilityMatrix(view []group.Node, views [][]group.Node) *reachabilityMatrix {
+	matrix := &reachabilityMatrix{Time: time.Now()}
+	index := make(map[string]int)
+
+	// each member is known by its server UUID, as its 'host:port' can differ between the views
+	add := func(node group.Node) int {
+		key := node.ServerUuid
+
+		if key == "" {
+			key = node.MySQLHost + ":" + node.MySQLPort
+		}
+
+		if i, ok := index[key]; ok {
+			return i
+		}
+
+		index[key] = len(matrix.nodes)
+		matrix.nodes = append(matrix.nodes, node)
+		matrix.Members = append(matrix.Members, node.MySQLHost+":"+node.MySQLPort)
+		matrix.observed = append(matrix.observed, false)
+
+		return index[key]
+	}
+
+	rows := make(map[int][]group.Node)
+
+	for i := range view {
+		row := add(view[i])
+
+		if views[i] != nil {
+			matrix.observed[row] = true
+			rows[row] = views[i]
+
+			for _, seen := range views[i] {
+				add(seen)
+			}
+		}
+	}
+
+	matrix.States = make([][]string, len(matrix.nodes))
+
+	for i := range matrix.nodes {
+		matrix.States[i] = make([]string, len(matrix.nodes))
+
+		if !matrix.observed[i] {
+			for j := range matrix.States[i] {
+				matrix.States[i][j] = notObserved
+			}
+
+			continue
+		}
+
+		for _, seen := range rows[i] {
+			matrix.States[i][add(seen)] = seen.MemberState
+		}
+	}
+
+	matrix.findPartitions()
+
+	return matrix
+}
+
+/*
+findPartitions groups the members that all see each other as ONLINE, so that each partition is fully connected: A
+seeing B and B seeing C doesn't make a partition of all three if A and C can't see each other. The largest such group
+is taken first, then the largest of the members that are left, and so on. A member that we couldn't ask is taken to
+see those that see it as ONLINE, and two such members are only grouped when someone sees both of them as ONLINE. A
+member that no one sees as ONLINE, e.g. as it's down or in the ERROR state, is isolated.
+*/
+func (m *reachabilityMatrix) findPartitions() {
+	online := make([]bool, len(m.nodes))
+
+	for i := range m.nodes {
+		for j := range m.nodes {
+			if m.States[i][j] == "ONLINE" {
+				online[j] = true
+			}
+		}
+	}
+
+	// sees tells us if the member sees the other one as ONLINE, which we assume for a member that we couldn't ask
+	sees := func(i int, j int) bool {
+		return !m.observed[i] || m.States[i][j] == "ONLINE"
+	}
+
+	linked := func(i int, j int) bool {
+		if m.observed[i] || m.observed[j] {
+			return sees(i, j) && sees(j, i)
+		}
+
+		for k := range m.nodes {
+			if m.observed[k] && m.States[k][i] == "ONLINE" && m.States[k][j] == "ONLINE" {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	remaining := []int{}
+
+	for i := range m.nodes {
+		if online[i] {
+			remaining = append(remaining, i)
+		}
+	}
+
+	// each member's partition is known by its first member
+	first := make([]int, len(m.nodes))
+	groups := make(map[int]*reachPartition)
+	firsts := []int{}
+
+	for len(remaining) > 0 {
+		clique := largestClique(remaining, linked)
+		left := remaining[:0]
+
+		for _, i := range remaining {
+			if containsIndex(clique, i) {
+				first[i] = clique[0]
+			} else {
+				left = append(left, i)
+			}
+		}
+
+		remaining = left
+		groups[clique[0]] = &reachPartition{}
+		firsts = append(firsts, clique[0])
+	}
+
+	for i := range m.nodes {
+		if !online[i] {
+			m.Isolated = append(m.Isolated, m.Members[i])
+			continue
+		}
+
+		groups[first[i]].Members = append(groups[first[i]].Members, m.Members[i])
+		groups[first[i]].index = append(groups[first[i]].index, i)
+	}
+
+	m.Partitions = []reachPartition{}
+
+	for _, f := range firsts {
+		p := groups[f]
+		p.Quorum = len(p.Members)*2 > len(m.nodes)
+		m.Partitions = append(m.Partitions, *p)
+	}
+
+	// the largest partitions first
+	sort.SliceStable(m.Partitions, func(i, j int) bool {
+		return len(m.Partitions[i].Members) > len(m.Partitions[j].Members)
+	})
+}
+
+/*
+largestClique returns the largest set of the members that are all linked to each other, the first one found in the
+members' order when there's a tie. A group has at most 9 members, so an exhaustive search is cheap enough.
+*/
+func largestClique(members []int, linked func(i int, j int) bool) []int {
+	var best []int
+
+	var grow func(clique []int, candidates []int)
+	grow = func(clique []int, candidates []int) {
+		if len(clique)+len(candidates) <= len(best) {
+			return
+		}
+
+		if len(candidates) == 0 {
+			best = append([]int{}, clique...)
+			return
+		}
+
+		first := candidates[0]
+		with := []int{}
+
+		for _, c := range candidates[1:] {
+			if linked(first, c) {
+				with = append(with, c)
+			}
+		}
+
+		grow(append(append([]int{}, clique...), first), with)
+		grow(clique, candidates[1:])
+	}
+
+	grow(nil, members)
+
+	return best
+}
+
+func containsIndex(indexes []int, i int) bool {
+	for _, index := range indexes {
+		if index == i {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+candidate returns the member of the partition that should become the new primary one: the largest partition or, if
+there's no clear winner based on partition size, the partition that has executed the most GTIDs, as counted by
+trxCount. Only the partitions with a member that we could ask are considered, and that member is the one returned.
+*/
+func (m *reachabilityMatrix) candidate(logger *slog.Logger, trxCount func(node group.Node) uint64) (group.Node, bool) {
+	var best group.Node
+	bestSize := 0
+	var bestTrxCount uint64
+	found := false
+
+	for _, p := range m.Partitions {
+		if found && len(p.Members) < bestSize {
+			break
+		}
+
+		for _, i := range p.index {
+			if !m.observed[i] {
+				continue
+			}
+
+			node := m.nodes[i]
+			count := trxCount(node)
+
+			if !found || count > bestTrxCount {
+				best, bestSize, bestTrxCount, found = node, len(p.Members), count, true
+			}
+		}
+	}
+
+	if found {
+		logger.Debug("Chose the partition to force from the reachability matrix", "partitions", m.Partitions, "candidate", best.MySQLHost+":"+best.MySQLPort)
+	}
+
+	return best, found
+}
+
+// ASCII renders the matrix as a table, along with the partitions
+func (m *reachabilityMatrix) ASCII() string {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "%s\t%s\t\n", "OBSERVER \\ MEMBER", strings.Join(m.Members, "\t"))
+
+	for i := range m.Members {
+		states := make([]string, len(m.States[i]))
+
+		for j, state := range m.States[i] {
+			states[j] = state
+
+			if state == "" {
+				states[j] = "?"
+			}
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t\n", m.Members[i], strings.Join(states, "\t"))
+	}
+
+	tw.Flush()
+	buf.WriteString("\n")
+
+	for i, p := range m.Partitions {
+		quorum := "no quorum"
+
+		if p.Quorum {
+			quorum = "quorum"
+		}
+
+		fmt.Fprintf(&buf, "Partition %d (%s): %s\n", i+1, quorum, strings.Join(p.Members, ", "))
+	}
+
+	if len(m.Isolated) > 0 {
+		fmt.Fprintf(&buf, "Isolated: %s\n", strings.Join(m.Isolated, ", "))
+	}
+
+	return buf.String()
+}
+
+// collectReachability builds the matrix for the members, keeping it for the API and logging when the partitions change
+func collectReachability(logger *slog.Logger, members []group.Node) *reachabilityMatrix {
+	matrix := buildReachability(members)
+
+	reachability.Lock()
+	previous := reachability.latest
+	reachability.latest = matrix
+	reachability.Unlock()
+
+	if previous == nil || partitionsKey(previous) != partitionsKey(matrix) {
+		if len(matrix.Partitions) > 1 || len(matrix.Isolated) > 0 {
+			logger.Warn("The members see the group as partitioned", "partitions", matrix.Partitions, "isolated", matrix.Isolated)
+		} else if previous != nil {
+			logger.Info("The members see the group as whole again", "partitions", matrix.Partitions)
+		}
+	}
+
+	return matrix
+}
+
+func partitionsKey(m *reachabilityMatrix) string {
+	key := ""
+
+	for _, p := range m.Partitions {
+		key += strings.Join(p.Members, ",") + ";"
+	}
+
+	return key + strings.Join(m.Isolated, ",")
+}
+
+// This will serve the reachability matrix via a simple RESTful API, as JSON or as a table with ?format=ascii
+func reachabilityHandler(httpW http.ResponseWriter, httpR *http.Request) {
+	Log.Debug("Handling HTTP request for reachability")
+
+	reachability.RLock()
+	matrix := reachability.latest
+	reachability.RUnlock()
+
+	if matrix == nil {
+		http.Error(httpW, "No reachability matrix has been collected yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	if httpR.URL.Query().Get("format") == "ascii" {
+		httpW.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(httpW, "%s", matrix.ASCII())
+		return
+	}
+
+	matrixJSON, err := json.MarshalIndent(matrix, "", "    ")
+
+	if err != nil {
+		Log.Error("Error handling HTTP request for reachability", logging.KeyError, err)
+	}
+
+	httpW.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(httpW, "%s", matrixJSON)
+}
@@ -0,0 +1,124 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+var testLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testNode is a member known by its host, with the default MySQL port
+func testNode(host string, state string, online uint8) group.Node {
+	return group.Node{MySQLHost: host, MySQLPort: "3306", ServerUuid: host, MemberState: state, OnlineParticipants: online}
+}
+
+// testView is how a member sees the others, each of hosts being ONLINE and any others in the group UNREACHABLE
+func testView(all []string, hosts ...string) []group.Node {
+	var view []group.Node
+
+	for _, host := range all {
+		state := "UNREACHABLE"
+
+		for _, h := range hosts {
+			if h == host {
+				state = "ONLINE"
+			}
+		}
+
+		view = append(view, testNode(host, state, 0))
+	}
+
+	return view
+}
+
+func TestFindPartitions(t *testing.T) {
+	all := []string{"a", "b", "c", "d", "e"}
+
+	tests := []struct {
+		name string
+		// sees is who each member sees as ONLINE, nil for a member that we couldn't ask
+		sees       [][]string
+		partitions [][]string
+		isolated   []string
+	}{
+		{
+			name:       "the whole group",
+			sees:       [][]string{all, all, all, all, all},
+			partitions: [][]string{{"a:3306", "b:3306", "c:3306", "d:3306", "e:3306"}},
+		},
+		{
+			name:       "split in two",
+			sees:       [][]string{{"a", "b"}, {"a", "b"}, {"c", "d", "e"}, {"c", "d", "e"}, {"c", "d", "e"}},
+			partitions: [][]string{{"c:3306", "d:3306", "e:3306"}, {"a:3306", "b:3306"}},
+		},
+		{
+			name:       "a chain isn't one partition",
+			sees:       [][]string{{"a", "b"}, {"a", "b", "c"}, {"b", "c"}, {"d", "e"}, {"d", "e"}},
+			partitions: [][]string{{"a:3306", "b:3306"}, {"d:3306", "e:3306"}, {"c:3306"}},
+		},
+		{
+			name:       "the largest fully connected group is taken first",
+			sees:       [][]string{{"a", "b"}, {"a", "b", "c", "d"}, {"b", "c", "d"}, {"b", "c", "d"}, {"e"}},
+			partitions: [][]string{{"b:3306", "c:3306", "d:3306"}, {"a:3306"}, {"e:3306"}},
+		},
+		{
+			name:       "members that we couldn't ask are placed with those that see them",
+			sees:       [][]string{{"a", "b", "c"}, nil, nil, {"d", "e"}, {"d", "e"}},
+			partitions: [][]string{{"a:3306", "b:3306", "c:3306"}, {"d:3306", "e:3306"}},
+		},
+		{
+			name:       "members that we couldn't ask aren't grouped when no one sees both",
+			sees:       [][]string{{"a", "b"}, nil, {"c", "d"}, nil, {"e"}},
+			partitions: [][]string{{"a:3306", "b:3306"}, {"c:3306", "d:3306"}, {"e:3306"}},
+		},
+		{
+			name:       "a member that no one sees as ONLINE is isolated",
+			sees:       [][]string{{"a", "b", "c", "d"}, {"a", "b", "c", "d"}, {"a", "b", "c", "d"}, {"a", "b", "c", "d"}, nil},
+			partitions: [][]string{{"a:3306", "b:3306", "c:3306", "d:3306"}},
+			isolated:   []string{"e:3306"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			views := make([][]group.Node, len(all))
+
+			for i, sees := range tt.sees {
+				if sees != nil {
+					views[i] = testView(all, sees...)
+				}
+			}
+
+			matrix := newReachabilityMatrix(testView(all, all...), views)
+			var partitions [][]string
+
+			for _, p := range matrix.Partitions {
+				partitions = append(partitions, p.Members)
+			}
+
+			if !reflect.DeepEqual(partitions, tt.partitions) || !reflect.DeepEqual(matrix.Isolated, tt.isolated) {
+				t.Errorf("partitions %v and isolated %v, want %v and %v\n%s", partitions, matrix.Isolated, tt.partitions, tt.isolated, matrix.ASCII())
+			}
+		})
+	}
+}
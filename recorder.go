@@ -0,0 +1,341 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/recording"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+/*
+loopRecord is what we observed of the cluster during one loop, as written to the -record file. It's a hypothetical
+cluster for simulate, so that the replay command can feed it through the same decisions that MonitorCluster makes.
+*/
+type loopRecord struct {
+	Time time.Time `json:"time"`
+	Loop uint      `json:"loop"`
+	simCluster
+	// Probes are the probes of each member's MySQL and XCom ports
+	Probes []memberProbe `json:"probes,omitempty"`
+	// Error is why we couldn't observe the group on this loop, e.g. when no valid seed node was found
+	Error string `json:"error,omitempty"`
+}
+
+// loopRecorder writes a loopRecord for each loop to the -record file
+type loopRecorder struct {
+	sync.Mutex
+	out *recording.Writer
+}
+
+var recorder = &loopRecorder{}
+
+func (me *loopRecorder) enabled() bool {
+	me.Lock()
+	defer me.Unlock()
+
+	return me.out != nil
+}
+
+/*
+observed records what we've observed of the group on this loop. Each member is asked again for its own state, its
+quorum and its executed GTIDs, while its view of the group is taken from the reachability matrix. So the recording
+costs a round trip to each member per loop, which is why it's only done with -record.
+*/
+func (me *loopRecorder) observed(logger *slog.Logger, loop uint, seedNode group.Node, matrix *reachabilityMatrix, probes []memberProbe) {
+	if !me.enabled() {
+		return
+	}
+
+	rec := loopRecord{Time: time.Now(), Loop: loop, Probes: probes}
+	rec.Cluster = seedNode.GroupName
+	rec.Seed = seedNode.MySQLHost + ":" + seedNode.MySQLPort
+	rec.MinOnlineMembers = minOnlineMembers
+	rec.Members = make([]simMember, len(matrix.nodes))
+
+	var wg sync.WaitGroup
+
+	for i := range matrix.nodes {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			rec.Members[i] = observeMember(matrix, i)
+		}(i)
+	}
+
+	wg.Wait()
+
+	me.write(logger, rec)
+}
+
+// failed records a loop on which we couldn't observe the group, and why
+func (me *loopRecorder) failed(logger *slog.Logger, loop uint, seedNode group.Node, reason string) {
+	if !me.enabled() {
+		return
+	}
+
+	rec := loopRecord{Time: time.Now(), Loop: loop, Error: reason}
+	rec.Cluster = seedNode.GroupName
+	rec.Seed = seedNode.MySQLHost + ":" + seedNode.MySQLPort
+
+	me.write(logger, rec)
+}
+
+func (me *loopRecorder) write(logger *slog.Logger, rec loopRecord) {
+	me.Lock()
+	defer me.Unlock()
+
+	if me.out == nil {
+		return
+	}
+
+	if err := me.out.Append(rec); err != nil {
+		logger.Error("Could not write to the recording", logging.KeyError, err)
+	}
+}
+
+func (me *loopRecorder) close() {
+	me.Lock()
+	defer me.Unlock()
+
+	if me.out != nil {
+		if err := me.out.Close(); err != nil {
+			Log.Error("Could not close the recording", logging.KeyError, err)
+		}
+
+		me.out = nil
+	}
+}
+
+// observeMember asks the member in the matrix's row for its own state, quorum, executed GTIDs and GCS endpoint
+func observeMember(matrix *reachabilityMatrix, row int) simMember {
+	node := matrix.nodes[row]
+	reachable := false
+	member := simMember{Host: node.MySQLHost, Port: node.MySQLPort, ServerUUID: node.ServerUuid, State: node.MemberState, Reachable: &reachable}
+
+	// if it couldn't tell us its view of the group, then it's as good as unreachable for our decisions
+	if !matrix.observed[row] {
+		member.Error = "could not get its view of the group"
+		return member
+	}
+
+	member.Sees = make(map[string]string)
+
+	for col, state := range matrix.States[row] {
+		if state != "" {
+			member.Sees[matrix.Members[col]] = state
+		}
+	}
+
+	err := node.Connect()
+	noteConnectResult(&node, err)
+	defer node.Cleanup()
+
+	if err != nil {
+		member.Error = err.Error()
+		return member
+	}
+
+	reachable = true
+	member.State = node.MemberState
+	var errs []string
+
+	// the same as MonitorCluster, the quorum isn't asked for once Group Replication has been stopped
+	if node.MemberState != "OFFLINE" {
+		quorum, qerr := node.HasQuorum()
+
+		if qerr == nil {
+			member.Quorum = &quorum
+		} else {
+			errs = append(errs, qerr.Error())
+		}
+	}
+
+	if member.GTIDExecuted, err = node.TransactionsExecuted(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	xcomProbes.Lock()
+	endpoint, known := xcomProbes.endpoints[node.ServerUuid]
+	xcomProbes.Unlock()
+
+	if !known {
+		endpoint, err = node.GetGCSEndpoint()
+		known = err == nil
+	}
+
+	if known {
+		member.GCSAddress = endpoint.String()
+	}
+
+	member.Error = strings.Join(errs, "; ")
+
+	return member
+}
+
+// replayCommand feeds a recording through the decisions of MonitorCluster, it's run via: myarbitratord replay <file>
+func replayCommand(args []string) int {
+	cmdFlags := flag.NewFlagSet("replay", flag.ExitOnError)
+	path := cmdFlags.String("file", "", "The recording to replay, it can also be given as an argument, - reads it from stdin")
+	format := cmdFlags.String("format", "text", "The format of the decisions: text or json, one per line")
+	changes := cmdFlags.Bool("changes", false, "Only print the loops whose decision differs from the previous loop's")
+	verbose := cmdFlags.Bool("verbose", false, "Also print why each decision was made, and the reachability matrix")
+	cmdFlags.DurationVar(&forceConfirmDelay, "force-confirm-delay", 0, "The -force-confirm-delay to replay with")
+	cmdFlags.BoolVar(&forceApproval, "force-approval", false, "The -force-approval to replay with")
+	cmdFlags.Parse(args)
+
+	if *path == "" && cmdFlags.NArg() > 0 {
+		*path = cmdFlags.Arg(0)
+	}
+
+	if *path == "" || (*format != "text" && *format != "json") {
+		fmt.Fprintf(os.Stderr, "Usage of %s replay:\n", os.Args[0])
+		cmdFlags.PrintDefaults()
+		return 1
+	}
+
+	// we're only replaying, so there's nothing worth logging
+	Log, _ = logging.New(ioutil.Discard, logging.FormatLogfmt, slog.LevelError)
+
+	in, err := recording.Open(*path)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read the recording: %v\n", err)
+		return 1
+	}
+
+	defer in.Close()
+
+	count, failures := 0, 0
+	last := ""
+
+	for {
+		var rec loopRecord
+
+		if err = in.Next(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read the recording after %d loop(s): %v\n", count, err)
+			return 1
+		}
+
+		count++
+		replayed := replayedLoop{Loop: rec.Loop, Time: rec.Time, Error: rec.Error}
+
+		// the loops on which the group couldn't be observed were only retried, there was no decision to make
+		if rec.Error == "" {
+			result, serr := simulate(rec.simCluster)
+
+			if serr != nil {
+				replayed.Error = "could not be replayed: " + serr.Error()
+				failures++
+			} else {
+				replayed.Result = &result
+			}
+		}
+
+		key := replayed.key()
+
+		if *changes && key == last {
+			continue
+		}
+
+		last = key
+
+		if *format == "json" {
+			line, _ := json.Marshal(replayed)
+			fmt.Printf("%s\n", line)
+		} else {
+			replayed.print(*verbose)
+		}
+	}
+
+	if failures > 0 {
+		fmt.Fprintf(os.Stderr, "%d of the %d loop(s) could not be replayed\n", failures, count)
+		return 2
+	}
+
+	return 0
+}
+
+// replayedLoop is the decision that a recorded loop replays to
+type replayedLoop struct {
+	Loop   uint       `json:"loop"`
+	Time   time.Time  `json:"time"`
+	Error  string     `json:"error,omitempty"`
+	Result *simResult `json:"result,omitempty"`
+}
+
+// key tells the loops with the same decision, and the same actions, apart from the others
+func (r replayedLoop) key() string {
+	if r.Result == nil {
+		return "error: " + r.Error
+	}
+
+	key := r.Result.Decision + " " + r.Result.Seed
+
+	for _, act := range r.Result.Actions {
+		key += "; " + act.Action + " " + act.Node + " " + act.Refused
+	}
+
+	return key
+}
+
+func (r replayedLoop) print(verbose bool) {
+	header := fmt.Sprintf("Loop %d (%s): ", r.Loop, r.Time.Format(time.RFC3339))
+
+	if r.Result == nil {
+		fmt.Printf("%sskipped, %s\n", header, r.Error)
+		return
+	}
+
+	fmt.Printf("%s%s, seed node %s (quorum: %t)\n", header, r.Result.Decision, r.Result.Seed, r.Result.SeedQuorum)
+
+	if r.Result.ForceMembers != "" {
+		fmt.Printf("  force members: %s\n", r.Result.ForceMembers)
+	}
+
+	for _, act := range r.Result.Actions {
+		line := "  " + act.Action + " " + act.Node + ": " + act.Reason
+
+		if act.Refused != "" {
+			line += " [REFUSED: " + act.Refused + "]"
+		}
+
+		fmt.Println(line)
+	}
+
+	if verbose {
+		for _, reason := range r.Result.Reasons {
+			fmt.Printf("  why: %s\n", reason)
+		}
+
+		fmt.Printf("\n%s\n", r.Result.Matrix)
+	}
+}
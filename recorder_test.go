@@ -0,0 +1,70 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mattlord/myarbitratord/recording"
+	"github.com/mattlord/myarbitratord/replication/group/grouptest"
+)
+
+// a recorded loop must replay to the same decision that MonitorCluster made on it
+func TestReplayTiedSplit(t *testing.T) {
+	defer grouptest.Reset()
+
+	view := stubTiedSplit()
+	live := pickForceCandidate(testLog, view)
+
+	path := filepath.Join(t.TempDir(), "record.ndjson.gz")
+	out, err := recording.Create(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder.out = out
+	seedNode := view[0]
+	seedNode.GroupName = "550fa9ee-a1f8-4b6d-9bfe-c03c12cd1c72"
+	recorder.observed(testLog, 1, seedNode, collectReachability(testLog, view), nil)
+	recorder.close()
+
+	in, err := recording.Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer in.Close()
+
+	var rec loopRecord
+
+	if err = in.Next(&rec); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := simulate(rec.simCluster)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Decision != simForce || len(result.Actions) == 0 || result.Actions[0].Node != live.MySQLHost+":"+live.MySQLPort {
+		t.Errorf("replayed to %s with actions %+v, want the membership forced on %s:%s as it was live", result.Decision, result.Actions, live.MySQLHost, live.MySQLPort)
+	}
+}
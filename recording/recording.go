@@ -0,0 +1,268 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package recording writes and reads a gzip compressed file of newline delimited JSON records, so that what the
+arbitrator observed on each loop can be replayed offline. Each time the file is opened for writing, a new gzip member
+is appended to it, and a reader sees all of them as one stream of records. A member left incomplete by a writer that
+was killed is completed before the next one is appended, as a reader can't read past it otherwise.
+*/
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Writer is an open recording file
+type Writer struct {
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+}
+
+// Create opens the recording for appending, creating it if needed, after completing its last member if it must be
+func Create(path string) (*Writer, error) {
+	if err := recoverLast(path); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{file: file, gz: gzip.NewWriter(file)}, nil
+}
+
+// countingReader counts the bytes read, it's a flate.Reader so that the gzip reader doesn't read ahead of the member
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+
+	if err == nil {
+		c.n++
+	}
+
+	return b, err
+}
+
+/*
+recoverLast completes the recording's last gzip member when the arbitrator was killed while writing it. Without its
+trailer a reader can't get past it to the members appended after it, so it's replaced by a complete member holding
+every record that was flushed to it. Anything else that's wrong with the recording is returned as an error, rather
+than risk losing any of it.
+*/
+func recoverLast(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	in := &countingReader{r: bufio.NewReader(file)}
+
+	for {
+		// where the member that we're about to read starts
+		start := in.n
+		gz, err := gzip.NewReader(in)
+
+		if err == io.EOF {
+			return nil
+		}
+
+		var records []byte
+
+		if err == nil {
+			gz.Multistream(false)
+			records, err = ioutil.ReadAll(gz)
+		}
+
+		if err == nil {
+			continue
+		}
+
+		if err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("The recording %s can't be appended to, as it's not valid at offset %d: %v", path, start, err)
+		}
+
+		// the last record may only have been partly written
+		records = records[:bytes.LastIndexByte(records, '\n')+1]
+
+		if err = file.Truncate(start); err != nil {
+			return err
+		}
+
+		if _, err = file.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+
+		out := gzip.NewWriter(file)
+
+		if _, err = out.Write(records); err == nil {
+			err = out.Close()
+		}
+
+		if err == nil {
+			err = file.Sync()
+		}
+
+		return err
+	}
+}
+
+// Append writes the record as one line, flushing it so that it can be read even if we're killed before Close
+func (w *Writer) Append(rec interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return errors.New("The recording has been closed!")
+	}
+
+	line, err := json.Marshal(rec)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.gz.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return w.gz.Flush()
+}
+
+// Close completes the gzip member and closes the recording file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.gz.Close()
+
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+
+	w.file = nil
+
+	return err
+}
+
+// Reader reads the records from a recording, which can also be uncompressed NDJSON
+type Reader struct {
+	closer  io.Closer
+	scanner *bufio.Scanner
+	line    int
+}
+
+// Open opens the recording at path for reading, or stdin when it's "-"
+func Open(path string) (*Reader, error) {
+	var file *os.File
+
+	if path == "-" {
+		file = os.Stdin
+	} else {
+		var err error
+
+		if file, err = os.Open(path); err != nil {
+			return nil, err
+		}
+	}
+
+	in := bufio.NewReader(file)
+	var records io.Reader = in
+
+	// the gzip magic number, otherwise we take it to be plain NDJSON, e.g. an extract of a recording
+	if magic, _ := in.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(in)
+
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		records = gz
+	}
+
+	scanner := bufio.NewScanner(records)
+	// each member's view of the group can make for long lines
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	return &Reader{closer: file, scanner: scanner}, nil
+}
+
+// Next decodes the next record into rec, it returns io.EOF once there are no more records
+func (r *Reader) Next(rec interface{}) error {
+	for r.scanner.Scan() {
+		r.line++
+
+		if len(r.scanner.Bytes()) == 0 {
+			continue
+		}
+
+		if err := json.Unmarshal(r.scanner.Bytes(), rec); err != nil {
+			return fmt.Errorf("line %d: could not parse the record: %v", r.line, err)
+		}
+
+		return nil
+	}
+
+	err := r.scanner.Err()
+
+	// the last gzip member isn't complete while the arbitrator is still writing it, or once it was killed, but every
+	// record written to it was flushed. Create completes it before appending another one.
+	if err == nil || err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+
+	return err
+}
+
+// Close closes the recording file
+func (r *Reader) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,156 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package recording
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testRecord struct {
+	Loop int `json:"loop"`
+}
+
+// appendLoops appends a record for each of the loops
+func appendLoops(t *testing.T, w *Writer, loops ...int) {
+	t.Helper()
+
+	for _, loop := range loops {
+		if err := w.Append(testRecord{Loop: loop}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readLoops reads back the loop of each record in the recording
+func readLoops(t *testing.T, path string) []int {
+	t.Helper()
+
+	r, err := Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	var loops []int
+
+	for {
+		var rec testRecord
+
+		if err := r.Next(&rec); err == io.EOF {
+			return loops
+		} else if err != nil {
+			t.Fatalf("after loops %v: %v", loops, err)
+		}
+
+		loops = append(loops, rec.Loop)
+	}
+}
+
+// kill leaves the writer's gzip member without its trailer, as when the arbitrator is killed
+func kill(w *Writer) {
+	w.file.Close()
+	w.file = nil
+}
+
+func TestRecordingAcrossRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.ndjson.gz")
+
+	tests := []struct {
+		name   string
+		loops  []int
+		killed bool
+		want   []int
+	}{
+		{"a clean run", []int{1, 2}, false, []int{1, 2}},
+		{"a killed run", []int{3, 4}, true, []int{1, 2, 3, 4}},
+		{"the run after it", []int{5}, false, []int{1, 2, 3, 4, 5}},
+		{"two killed runs in a row", []int{6}, true, []int{1, 2, 3, 4, 5, 6}},
+		{"and another", []int{7}, true, []int{1, 2, 3, 4, 5, 6, 7}},
+		{"and a clean run", []int{8}, false, []int{1, 2, 3, 4, 5, 6, 7, 8}},
+	}
+
+	for _, tt := range tests {
+		w, err := Create(path)
+
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		appendLoops(t, w, tt.loops...)
+
+		if tt.killed {
+			kill(w)
+		} else if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := readLoops(t, path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: read loops %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRecordingPartialRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.ndjson.gz")
+
+	w, err := Create(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appendLoops(t, w, 1, 2)
+	// a record that was only partly written when we were killed
+	w.gz.Write([]byte(`{"loop":`))
+	w.gz.Flush()
+	kill(w)
+
+	if w, err = Create(path); err != nil {
+		t.Fatal(err)
+	}
+
+	appendLoops(t, w, 3)
+	w.Close()
+
+	if got := readLoops(t, path); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Errorf("read loops %v, want [1 2 3]", got)
+	}
+}
+
+func TestRecordingNotGzip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.ndjson")
+
+	if err := ioutil.WriteFile(path, []byte("{\"loop\":1}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Create(path); err == nil || !strings.Contains(err.Error(), "can't be appended to") {
+		t.Errorf("Create() = %v, want it refused", err)
+	}
+
+	// and it's left as it was
+	if contents, _ := ioutil.ReadFile(path); string(contents) != "{\"loop\":1}\n" {
+		t.Errorf("the recording was changed to %q", contents)
+	}
+}
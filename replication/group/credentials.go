@@ -0,0 +1,293 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package group
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Credentials is a mysql account used when connecting to the nodes
+type Credentials struct {
+	User     string
+	Password string
+}
+
+// String masks the password, so that Credentials can be safely logged
+func (c Credentials) String() string {
+	pass := ""
+
+	if c.Password != "" {
+		pass = "********"
+	}
+
+	return fmt.Sprintf("{User:%s Password:%s}", c.User, pass)
+}
+
+// CredentialOverride gives the credentials to use for the nodes that it matches, rather than the global ones
+type CredentialOverride struct {
+	// only one of these is needed, the Label is a shell pattern such as "dmz-*"
+	ServerUUID string
+	Endpoint   string
+	Label      string
+	Credentials
+}
+
+// ErrAuthFailed is returned by Connect when none of the known credentials were accepted by the node
+var ErrAuthFailed = errors.New("Authentication failed using all known credentials!")
+
+// the MySQL error codes that mean our credentials were rejected
+const (
+	ER_DBACCESS_DENIED_ERROR           uint16 = 1044
+	ER_ACCESS_DENIED_ERROR             uint16 = 1045
+	ER_ACCESS_DENIED_NO_PASSWORD_ERROR uint16 = 1698
+)
+
+// the global credentials used by all Nodes, once they've been set
+type credentialStore struct {
+	sync.RWMutex
+	set      bool
+	current  Credentials
+	previous Credentials
+	rotated  time.Time
+	grace    time.Duration
+
+	overrides         []CredentialOverride
+	previousOverrides []CredentialOverride
+	overridesRotated  time.Time
+}
+
+var credStore credentialStore
+
+/*
+SetCredentials sets the credentials used by all Nodes, overriding the ones that each Node was created with. When
+called again with different credentials, the old ones will still be tried for the grace period if the new ones
+are rejected. This allows the account to be rotated on the mysqld side before or after the arbitrator picks up
+the new credentials. It returns true if the credentials changed.
+*/
+func SetCredentials(user string, pass string, grace time.Duration) bool {
+	newCreds := Credentials{User: user, Password: pass}
+
+	credStore.Lock()
+	defer credStore.Unlock()
+
+	credStore.grace = grace
+
+	if credStore.set && credStore.current == newCreds {
+		return false
+	}
+
+	if credStore.set {
+		credStore.previous = credStore.current
+		credStore.rotated = time.Now()
+	}
+
+	credStore.current = newCreds
+	credStore.set = true
+
+	Log.Debug("Credentials set", "user", user, "grace", grace)
+
+	// any pooled connections using credentials that we'll never try again can now be closed
+	pruneCredentialPool()
+
+	return true
+}
+
+/*
+SetCredentialOverrides sets the per-node credentials, for any members that don't use the same account as the rest of
+the group. As with SetCredentials, the previous overrides are still tried for the grace period after they change.
+It returns true if the overrides changed.
+*/
+func SetCredentialOverrides(overrides []CredentialOverride, grace time.Duration) bool {
+	credStore.Lock()
+	defer credStore.Unlock()
+
+	if sameOverrides(credStore.overrides, overrides) {
+		return false
+	}
+
+	if len(credStore.overrides) > 0 {
+		credStore.previousOverrides = credStore.overrides
+		credStore.overridesRotated = time.Now()
+	}
+
+	credStore.overrides = make([]CredentialOverride, len(overrides))
+	copy(credStore.overrides, overrides)
+	credStore.grace = grace
+
+	Log.Debug("Per-node credentials set", "entries", len(overrides))
+
+	pruneCredentialPool()
+
+	return true
+}
+
+func sameOverrides(a []CredentialOverride, b []CredentialOverride) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+matchOverride finds the override for the node, with the most specific match winning: the server UUID, then the
+'host:port' endpoint, and finally the label pattern, which only matches once the node's label has been read from the
+InnoDB Cluster metadata.
+*/
+func (me *Node) matchOverride(overrides []CredentialOverride) (Credentials, bool) {
+	endpoint := me.MySQLHost + ":" + me.MySQLPort
+
+	for _, o := range overrides {
+		if o.ServerUUID != "" && me.ServerUuid != "" && strings.EqualFold(o.ServerUUID, me.ServerUuid) {
+			return o.Credentials, true
+		}
+	}
+
+	for _, o := range overrides {
+		if o.Endpoint != "" && o.Endpoint == endpoint {
+			return o.Credentials, true
+		}
+	}
+
+	for _, o := range overrides {
+		if o.Label != "" && me.Label != "" {
+			if matched, _ := path.Match(o.Label, me.Label); matched {
+				return o.Credentials, true
+			}
+		}
+	}
+
+	return Credentials{}, false
+}
+
+// hasUUIDOverride tells us if the node's server UUID has its own credentials, other than the ones we're connected with
+func (me *Node) hasUUIDOverride() bool {
+	credStore.Lock()
+	defer credStore.Unlock()
+
+	for _, o := range credStore.overrides {
+		if o.ServerUUID != "" && strings.EqualFold(o.ServerUUID, me.ServerUuid) {
+			return o.Credentials != Credentials{User: me.MySQLUser, Password: me.mysqlPass}
+		}
+	}
+
+	return false
+}
+
+// credentialCandidates returns the credentials to try, in order, when connecting to the node
+func (me *Node) credentialCandidates() []Credentials {
+	var candidates []Credentials
+
+	credStore.Lock()
+	defer credStore.Unlock()
+
+	if !credStore.set && len(credStore.overrides) == 0 {
+		return []Credentials{{User: me.MySQLUser, Password: me.mysqlPass}}
+	}
+
+	// once the grace window has passed, let's forget the old credentials and their connections
+	if credStore.previous != (Credentials{}) && time.Since(credStore.rotated) >= credStore.grace {
+		Log.Debug("Grace period expired for the previous credentials", "user", credStore.previous.User)
+
+		credStore.previous = Credentials{}
+		pruneCredentialPool()
+	}
+
+	if len(credStore.previousOverrides) > 0 && time.Since(credStore.overridesRotated) >= credStore.grace {
+		Log.Debug("Grace period expired for the previous per-node credentials")
+
+		credStore.previousOverrides = nil
+		pruneCredentialPool()
+	}
+
+	// a node with its own credentials shouldn't ever fall back to the global ones
+	if creds, ok := me.matchOverride(credStore.overrides); ok {
+		candidates = append(candidates, creds)
+	}
+
+	if creds, ok := me.matchOverride(credStore.previousOverrides); ok && (len(candidates) == 0 || candidates[0] != creds) {
+		candidates = append(candidates, creds)
+	}
+
+	if len(candidates) == 0 {
+		if credStore.set {
+			candidates = append(candidates, credStore.current)
+		} else {
+			candidates = append(candidates, Credentials{User: me.MySQLUser, Password: me.mysqlPass})
+		}
+
+		if credStore.previous != (Credentials{}) {
+			candidates = append(candidates, credStore.previous)
+		}
+	}
+
+	return candidates
+}
+
+// pruneCredentialPool closes any pooled connections using credentials that are no longer current or in their
+// grace period. The caller must hold the credStore lock.
+func pruneCredentialPool() {
+	// the pool is only managed here once the global credentials have been set, otherwise each Node uses its own
+	if !credStore.set {
+		return
+	}
+
+	active := []Credentials{credStore.current}
+
+	if credStore.previous != (Credentials{}) {
+		active = append(active, credStore.previous)
+	}
+
+	for _, o := range credStore.overrides {
+		active = append(active, o.Credentials)
+	}
+
+	for _, o := range credStore.previousOverrides {
+		active = append(active, o.Credentials)
+	}
+
+	DefaultPool.retainCredentials(active)
+}
+
+// IsAuthError tells us if the error means that mysqld rejected our credentials
+func IsAuthError(err error) bool {
+	if err == ErrAuthFailed {
+		return true
+	}
+
+	if myerr, ok := err.(*mysql.MySQLError); ok {
+		switch myerr.Number {
+		case ER_DBACCESS_DENIED_ERROR, ER_ACCESS_DENIED_ERROR, ER_ACCESS_DENIED_NO_PASSWORD_ERROR:
+			return true
+		}
+	}
+
+	return false
+}
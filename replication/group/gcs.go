@@ -0,0 +1,175 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package group
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XComProbeTimeout is how long we wait for each member's XCom port to accept a connection when validating the GCS endpoints
+var XComProbeTimeout = 2 * time.Second
+
+// The reasons that a GCS endpoint fails validation
+const (
+	GCSSyntax      = "not in host:port form"
+	GCSUnbracketed = "IPv6 addresses must be in brackets, e.g. [fd00::1]:33061"
+	GCSBadHost     = "not a valid IP address or hostname"
+	GCSBadPort     = "not a valid port"
+	GCSDuplicate   = "listed more than once"
+	GCSUnreachable = "not reachable on the XCom port"
+)
+
+// GCSEndpoint is the GCS/XCom 'host:port' combination that a member uses to communicate with the rest of the group
+type GCSEndpoint struct {
+	Host string `json:"Host"`
+	Port string `json:"Port"`
+}
+
+// String returns the endpoint in the form used by group_replication_force_members, with any IPv6 address in brackets
+func (e GCSEndpoint) String() string {
+	return net.JoinHostPort(e.Host, e.Port)
+}
+
+// GCSEndpointError describes which GCS endpoint failed validation, and why
+type GCSEndpointError struct {
+	Endpoint string
+	Reason   string
+	Err      error
+}
+
+func (e *GCSEndpointError) Error() string {
+	msg := "invalid GCS endpoint '" + e.Endpoint + "': " + e.Reason
+
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	return msg
+}
+
+func (e *GCSEndpointError) Unwrap() error {
+	return e.Err
+}
+
+// ParseGCSEndpoint parses and validates a 'host:port' GCS address, such as the value of group_replication_local_address
+func ParseGCSEndpoint(addr string) (GCSEndpoint, error) {
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		// an IPv6 address without the brackets can't be told apart from the port
+		if !strings.HasPrefix(addr, "[") && strings.Count(addr, ":") > 1 {
+			return GCSEndpoint{}, &GCSEndpointError{Endpoint: addr, Reason: GCSUnbracketed}
+		}
+
+		return GCSEndpoint{}, &GCSEndpointError{Endpoint: addr, Reason: GCSSyntax, Err: err}
+	}
+
+	if !validHost(host) {
+		return GCSEndpoint{}, &GCSEndpointError{Endpoint: addr, Reason: GCSBadHost}
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return GCSEndpoint{}, &GCSEndpointError{Endpoint: addr, Reason: GCSBadPort}
+	}
+
+	return GCSEndpoint{Host: host, Port: port}, nil
+}
+
+// validHost tells us if the host is an IP address or a valid hostname, which also rules out any quoting
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+/*
+ValidateGCSEndpoints checks that each of the endpoints to force the membership to is valid, is only listed once, and
+is reachable on its XCom port, returning a *GCSEndpointError for the first one that isn't
+*/
+func ValidateGCSEndpoints(endpoints []GCSEndpoint) error {
+	if err := CheckGCSEndpoints(endpoints); err != nil {
+		return err
+	}
+
+	for _, e := range endpoints {
+		conn, err := net.DialTimeout("tcp", e.String(), XComProbeTimeout)
+
+		if err != nil {
+			return &GCSEndpointError{Endpoint: e.String(), Reason: GCSUnreachable, Err: err}
+		}
+
+		conn.Close()
+	}
+
+	return nil
+}
+
+// CheckGCSEndpoints is ValidateGCSEndpoints without connecting to the XCom ports
+func CheckGCSEndpoints(endpoints []GCSEndpoint) error {
+	seen := make(map[string]bool)
+
+	for _, e := range endpoints {
+		addr := e.String()
+
+		if _, err := ParseGCSEndpoint(addr); err != nil {
+			return err
+		}
+
+		// hostnames are case insensitive
+		key := strings.ToLower(addr)
+
+		if seen[key] {
+			return &GCSEndpointError{Endpoint: addr, Reason: GCSDuplicate}
+		}
+
+		seen[key] = true
+	}
+
+	return nil
+}
+
+// ForceMembersValue is the group_replication_force_members value for the endpoints
+func ForceMembersValue(endpoints []GCSEndpoint) string {
+	addrs := make([]string, len(endpoints))
+
+	for i, e := range endpoints {
+		addrs[i] = e.String()
+	}
+
+	return strings.Join(addrs, ",")
+}
@@ -0,0 +1,232 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+/*
+Package grouptest is a stand-in for the mysqld of each member of a group, so that the code which talks to the members
+can be tested without a MySQL server. Register it as the group package's driver with:
+
+	group.DriverName = grouptest.DriverName
+*/
+package grouptest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DriverName is the database/sql driver name that the stand-in is registered as
+const DriverName = "grouptest"
+
+// Member is the stand-in for one member's mysqld
+type Member struct {
+	mu sync.Mutex
+	// results are the rows returned for each query, by its text
+	results map[string][][]driver.Value
+	// executed are the statements that were executed, in order
+	executed []string
+}
+
+var members = struct {
+	sync.Mutex
+	byEndpoint map[string]*Member
+}{byEndpoint: make(map[string]*Member)}
+
+func init() {
+	sql.Register(DriverName, stubDriver{})
+}
+
+// Add starts the stand-in for the mysqld at the 'host:port' endpoint, replacing any previous one
+func Add(endpoint string) *Member {
+	m := &Member{results: make(map[string][][]driver.Value)}
+
+	members.Lock()
+	members.byEndpoint[endpoint] = m
+	members.Unlock()
+
+	return m
+}
+
+// Remove stops the stand-in at the endpoint, so that connecting to it fails as if mysqld were down
+func Remove(endpoint string) {
+	members.Lock()
+	delete(members.byEndpoint, endpoint)
+	members.Unlock()
+}
+
+// Reset stops all of the stand-ins
+func Reset() {
+	members.Lock()
+	members.byEndpoint = make(map[string]*Member)
+	members.Unlock()
+}
+
+// Returns sets the rows returned for the query, each row being a slice of column values
+func (m *Member) Returns(query string, rows ...[]driver.Value) *Member {
+	m.mu.Lock()
+	m.results[query] = rows
+	m.mu.Unlock()
+
+	return m
+}
+
+// Executed returns the statements that were executed on the member
+func (m *Member) Executed() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]string{}, m.executed...)
+}
+
+type stubDriver struct{}
+
+// Open finds the member from the '@tcp(host:port)/' in the DSN
+func (stubDriver) Open(dsn string) (driver.Conn, error) {
+	start := strings.Index(dsn, "@tcp(")
+	end := strings.Index(dsn, ")/")
+
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("grouptest: no endpoint in the DSN %q", dsn)
+	}
+
+	c := &conn{endpoint: dsn[start+len("@tcp(") : end]}
+
+	if c.member() == nil {
+		return nil, fmt.Errorf("grouptest: dial tcp %s: connection refused", c.endpoint)
+	}
+
+	return c, nil
+}
+
+// conn is a connection to the member at the endpoint, which is looked up again for each statement, as it can be
+// removed or replaced while the connection is pooled
+type conn struct {
+	endpoint string
+}
+
+func (c *conn) member() *Member {
+	members.Lock()
+	defer members.Unlock()
+
+	return members.byEndpoint[c.endpoint]
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{conn: c, query: query}, nil
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return nil, errors.New("grouptest: transactions aren't supported")
+}
+
+// Ping fails once the member has been removed, so that the pool opens a new connection, which then fails too
+func (c *conn) Ping(ctx context.Context) error {
+	if c.member() == nil {
+		return driver.ErrBadConn
+	}
+
+	return nil
+}
+
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	m := s.conn.member()
+
+	if m == nil {
+		return nil, driver.ErrBadConn
+	}
+
+	m.mu.Lock()
+	m.executed = append(m.executed, s.query)
+	m.mu.Unlock()
+
+	return driver.RowsAffected(0), nil
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	m := s.conn.member()
+
+	if m == nil {
+		return nil, driver.ErrBadConn
+	}
+
+	m.mu.Lock()
+	results, ok := m.results[s.query]
+	m.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("grouptest: no result for the query %q", s.query)
+	}
+
+	return &rows{results: results}, nil
+}
+
+type rows struct {
+	results [][]driver.Value
+	next    int
+}
+
+func (r *rows) Columns() []string {
+	columns := 0
+
+	if len(r.results) > 0 {
+		columns = len(r.results[0])
+	}
+
+	names := make([]string, columns)
+
+	for i := range names {
+		names[i] = fmt.Sprintf("c%d", i)
+	}
+
+	return names
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.results) {
+		return io.EOF
+	}
+
+	copy(dest, r.results[r.next])
+	r.next++
+
+	return nil
+}
@@ -0,0 +1,123 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package group
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// GR_MEMBER_STATS_QUERY gets the node's own replication stats on MySQL 8.0 and later
+const GR_MEMBER_STATS_QUERY string = "SELECT count_transactions_in_queue, count_transactions_checked, count_conflicts_detected, count_transactions_remote_in_applier_queue, count_transactions_remote_applied FROM replication_group_member_stats WHERE member_id=@@global.server_uuid"
+
+// GR_MEMBER_STATS_57_QUERY gets the node's own replication stats on MySQL 5.7, which has no applier stats
+const GR_MEMBER_STATS_57_QUERY string = "SELECT count_transactions_in_queue, count_transactions_checked, count_conflicts_detected FROM replication_group_member_stats WHERE member_id=@@global.server_uuid"
+
+// GR_FLOW_CONTROL_QUERY gets the node's flow control stats, which are available in MySQL 8.0.30 and later
+const GR_FLOW_CONTROL_QUERY string = "SELECT variable_name, variable_value FROM global_status WHERE variable_name IN ('Gr_flow_control_throttle_count', 'Gr_flow_control_throttle_time_sum', 'Gr_flow_control_throttle_active_count')"
+
+// ER_BAD_FIELD_ERROR is the MySQL error code for an unknown column, e.g. an 8.0 stats column on 5.7
+const ER_BAD_FIELD_ERROR uint16 = 1054
+
+// MemberStats is a sample of the replication stats that a member reports for itself
+type MemberStats struct {
+	Time       time.Time `json:"Time"`
+	ServerUUID string    `json:"Server UUID"`
+	// CertifierQueue is the transactions waiting for conflict detection
+	CertifierQueue uint64 `json:"Certifier Queue"`
+	// ApplierQueue is the transactions that have been certified, but not yet applied, i.e. the replication lag
+	ApplierQueue        uint64 `json:"Applier Queue"`
+	TransactionsChecked uint64 `json:"Transactions Checked"`
+	ConflictsDetected   uint64 `json:"Conflicts Detected"`
+	TransactionsApplied uint64 `json:"Transactions Applied"`
+	// the flow control stats, FlowControlThrottleTime being the total microseconds that it has throttled for
+	FlowControlThrottles    uint64 `json:"Flow Control Throttles"`
+	FlowControlThrottleTime uint64 `json:"Flow Control Throttle Time"`
+	FlowControlActive       bool   `json:"Flow Control Active"`
+}
+
+// QueueLength is the total of the transactions that this member has yet to certify or apply
+func (ms MemberStats) QueueLength() uint64 {
+	return ms.CertifierQueue + ms.ApplierQueue
+}
+
+/*
+GetMemberStats samples the node's replication stats. On MySQL 5.7 the applier queue is instead calculated from the
+received and executed GTID sets, the transactions applied are unknown, and on versions before 8.0.30 the flow control
+stats are unknown, so they're left as 0.
+*/
+func (me *Node) GetMemberStats() (MemberStats, error) {
+	stats := MemberStats{Time: time.Now(), ServerUUID: me.ServerUuid}
+
+	me.logger().Debug("Getting the member stats", "query", GR_MEMBER_STATS_QUERY)
+
+	err := me.ping()
+
+	if err != nil {
+		return stats, err
+	}
+
+	err = me.db.QueryRow(GR_MEMBER_STATS_QUERY).Scan(&stats.CertifierQueue, &stats.TransactionsChecked, &stats.ConflictsDetected, &stats.ApplierQueue, &stats.TransactionsApplied)
+
+	if myerr, ok := err.(*mysql.MySQLError); ok && myerr.Number == ER_BAD_FIELD_ERROR {
+		me.logger().Debug("Getting the MySQL 5.7 member stats", "query", GR_MEMBER_STATS_57_QUERY)
+
+		err = me.db.QueryRow(GR_MEMBER_STATS_57_QUERY).Scan(&stats.CertifierQueue, &stats.TransactionsChecked, &stats.ConflictsDetected)
+
+		if err == nil {
+			stats.ApplierQueue, err = me.ApplierQueueLength()
+		}
+	}
+
+	if err != nil {
+		return stats, err
+	}
+
+	me.logger().Debug("Getting the flow control stats", "query", GR_FLOW_CONTROL_QUERY)
+
+	rows, err := me.db.Query(GR_FLOW_CONTROL_QUERY)
+
+	if err != nil {
+		return stats, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, value string
+
+		if err = rows.Scan(&name, &value); err != nil {
+			return stats, err
+		}
+
+		count, _ := strconv.ParseUint(value, 10, 64)
+
+		switch strings.ToLower(name) {
+		case "gr_flow_control_throttle_count":
+			stats.FlowControlThrottles = count
+		case "gr_flow_control_throttle_time_sum":
+			stats.FlowControlThrottleTime = count
+		case "gr_flow_control_throttle_active_count":
+			stats.FlowControlActive = count > 0
+		}
+	}
+
+	return stats, rows.Err()
+}
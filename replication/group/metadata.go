@@ -0,0 +1,190 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package group
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// IC_METADATA_V2_QUERY gets the instances from the metadata schema used by MySQL Shell 8.0.19 and later
+const IC_METADATA_V2_QUERY string = "SELECT c.cluster_name, i.label, i.mysql_server_uuid, i.address FROM mysql_innodb_cluster_metadata.v2_instances i INNER JOIN mysql_innodb_cluster_metadata.v2_gr_clusters c ON(i.cluster_id=c.cluster_id) WHERE c.group_name = ?"
+
+// IC_METADATA_V1_QUERY gets the instances from the metadata schema used by older MySQL Shell releases
+const IC_METADATA_V1_QUERY string = "SELECT c.cluster_name, i.instance_name, i.mysql_server_uuid, JSON_UNQUOTE(JSON_EXTRACT(i.addresses, '$.mysqlClassic')) FROM mysql_innodb_cluster_metadata.instances i INNER JOIN mysql_innodb_cluster_metadata.replicasets r ON(i.replicaset_id=r.replicaset_id) INNER JOIN mysql_innodb_cluster_metadata.clusters c ON(r.cluster_id=c.cluster_id) WHERE JSON_UNQUOTE(JSON_EXTRACT(r.attributes, '$.group_replication_group_name')) = ?"
+
+// the MySQL error codes that mean the metadata schema, or the version of it that we tried, doesn't exist
+const (
+	ER_BAD_DB_ERROR  uint16 = 1049
+	ER_NO_SUCH_TABLE uint16 = 1146
+)
+
+// ErrNoMetadata is returned when the node has no InnoDB Cluster metadata for its group
+var ErrNoMetadata = errors.New("No InnoDB Cluster metadata found for the group!")
+
+// MetadataInstance is a member of the cluster as MySQL Shell recorded it in the InnoDB Cluster metadata
+type MetadataInstance struct {
+	Cluster    string `json:"Cluster Name"`
+	Label      string `json:"Label"`
+	ServerUUID string `json:"Server UUID"`
+	// Address is the 'host:port' of the classic MySQL protocol endpoint
+	Address string `json:"Address"`
+}
+
+// The ways that the metadata and the group membership can disagree
+const (
+	// MissingFromGroup is an instance in the metadata that isn't a member of the group
+	MissingFromGroup = "missing from the group"
+	// MissingFromMetadata is a member of the group that isn't an instance in the metadata
+	MissingFromMetadata = "missing from the metadata"
+)
+
+// MetadataDiscrepancy is a node that's only in one of the metadata or the group membership
+type MetadataDiscrepancy struct {
+	ServerUUID string `json:"Server UUID"`
+	Address    string `json:"Address"`
+	Label      string `json:"Label,omitempty"`
+	Problem    string `json:"Problem"`
+}
+
+/*
+GetMetadataInstances reads the instances in the node's group from the InnoDB Cluster metadata schema that MySQL Shell
+maintains, returning the version of the metadata schema that they were read from. The version 2 schema is tried
+first, falling back to version 1. ErrNoMetadata is returned if the group isn't managed with MySQL Shell.
+*/
+func (me *Node) GetMetadataInstances() (int, []MetadataInstance, error) {
+	var instances []MetadataInstance
+
+	err := me.ping()
+
+	if err != nil {
+		return 0, instances, err
+	}
+
+	for _, md := range []struct {
+		version int
+		query   string
+	}{{2, IC_METADATA_V2_QUERY}, {1, IC_METADATA_V1_QUERY}} {
+		me.logger().Debug("Getting the InnoDB Cluster metadata", "query", md.query, "metadata_version", md.version)
+
+		instances, err = me.queryMetadata(md.query)
+
+		if err == nil && len(instances) > 0 {
+			return md.version, instances, nil
+		}
+
+		if err != nil && !isMissingMetadata(err) {
+			return md.version, instances, err
+		}
+	}
+
+	return 0, instances, ErrNoMetadata
+}
+
+func (me *Node) queryMetadata(query string) ([]MetadataInstance, error) {
+	var instances []MetadataInstance
+
+	rows, err := me.db.Query(query, me.GroupName)
+
+	if err != nil {
+		return instances, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var instance MetadataInstance
+
+		if err = rows.Scan(&instance.Cluster, &instance.Label, &instance.ServerUUID, &instance.Address); err != nil {
+			return instances, err
+		}
+
+		instances = append(instances, instance)
+	}
+
+	return instances, rows.Err()
+}
+
+func isMissingMetadata(err error) bool {
+	if myerr, ok := err.(*mysql.MySQLError); ok {
+		return myerr.Number == ER_BAD_DB_ERROR || myerr.Number == ER_NO_SUCH_TABLE
+	}
+
+	return false
+}
+
+/*
+ReconcileMetadata matches the metadata instances with the group members, by server UUID, or by address when either
+has no server UUID recorded. Each matched member gets its label from the metadata, which is then used when matching
+the per-node credentials. It returns the nodes that are only found in one or the other.
+*/
+func ReconcileMetadata(instances []MetadataInstance, members []Node) []MetadataDiscrepancy {
+	var discrepancies []MetadataDiscrepancy
+
+	matched := make([]bool, len(instances))
+
+	for i := range members {
+		member := &members[i]
+		found := -1
+
+		for j, instance := range instances {
+			if !matched[j] && member.ServerUuid != "" && strings.EqualFold(instance.ServerUUID, member.ServerUuid) {
+				found = j
+				break
+			}
+		}
+
+		if found == -1 {
+			for j, instance := range instances {
+				// differing UUIDs at the same address means the instance was re-provisioned, which we'll want flagged
+				if !matched[j] && (instance.ServerUUID == "" || member.ServerUuid == "") && sameAddress(instance.Address, member.MySQLHost, member.MySQLPort) {
+					found = j
+					break
+				}
+			}
+		}
+
+		if found == -1 {
+			discrepancies = append(discrepancies, MetadataDiscrepancy{ServerUUID: member.ServerUuid, Address: net.JoinHostPort(member.MySQLHost, member.MySQLPort), Problem: MissingFromMetadata})
+			continue
+		}
+
+		matched[found] = true
+		member.Label = instances[found].Label
+	}
+
+	for j, instance := range instances {
+		if !matched[j] {
+			discrepancies = append(discrepancies, MetadataDiscrepancy{ServerUUID: instance.ServerUUID, Address: instance.Address, Label: instance.Label, Problem: MissingFromGroup})
+		}
+	}
+
+	return discrepancies
+}
+
+func sameAddress(address string, host string, port string) bool {
+	mdHost, mdPort, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(mdHost, host) && mdPort == port
+}
@@ -19,13 +19,16 @@ package group
 import (
 	"database/sql"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	// Anonymous import is required: http://go-database-sql.org/importing.html
 	_ "github.com/go-sql-driver/mysql"
+
+	"github.com/mattlord/myarbitratord/logging"
 )
 
 // Node represents a mysqld process participating in a Group Replication cluster
@@ -42,22 +45,31 @@ type Node struct {
 	OnlineParticipants uint8  `json:"Online Members,omitempty"`
 	Quorum             bool   `json:"Has Quorum,omitempty"`
 	ReadOnly           bool   `json:"Read Only,omitempty"`
-	db                 *sql.DB
+	// Label is the node's instance label in the InnoDB Cluster metadata, when that's known, for matching per-node credentials
+	Label string `json:"Label,omitempty"`
+	// AuthFailed notes that the node rejected all of our known credentials on the last Connect
+	AuthFailed bool `json:"Authentication Failed,omitempty"`
+	db         *sql.DB
 }
 
-// enable debug logging for all nodes
-var Debug bool = false
+// Log is the structured logger used for all nodes, this package writes debug level records, and errors when a node's
+// connection pool can't be opened
+var Log = slog.New(slog.NewTextHandler(os.Stderr, nil))
 
-// setup debug logging for all nodes
-var DebugLog = log.New(os.Stderr,
-	"DEBUG: ",
-	log.Ldate|log.Ltime|log.Lshortfile)
+/*
+Auditor is told about every statement that we send to a node which changes its state: Attempt right before it's sent,
+so that there's a record of it even if we're killed while it's in flight, and Mutation with its result.
+*/
+type Auditor interface {
+	Attempt(node *Node, statement string)
+	Mutation(node *Node, statement string, result error)
+}
 
-// let's maintain a simple global pool of database objects for all Nodes
-var dbcp map[string]*sql.DB = make(map[string]*sql.DB)
+// Audit is the Auditor for all nodes, nothing is audited when it's nil
+var Audit Auditor
 
-// it can be accessed by multiple threads, so let's protect access to it
-var DBCPMutex sync.Mutex
+// ErrNotConnected is returned when a Node is used before successfully connecting to it
+var ErrNotConnected = errors.New("Node has not been connected!")
 
 // GR_NAME_QUERY is a static query to get the group name (uuid)
 const GR_NAME_QUERY string = "SELECT variable_value FROM global_variables WHERE variable_name='group_replication_group_name'"
@@ -71,6 +83,9 @@ const GR_QUORUM_QUERY string = "SELECT IF( MEMBER_STATE='ONLINE' AND ((SELECT CO
 // GR_RO_QUERY is a static query to see if the node is READ ONLY
 const GR_RO_QUERY string = "SELECT variable_value FROM global_variables WHERE variable_name='super_read_only'"
 
+// GR_PRIMARY_QUERY is a static query to get the server UUID of the group's primary, which is empty in multi-primary mode
+const GR_PRIMARY_QUERY string = "SELECT variable_value FROM global_status WHERE variable_name='group_replication_primary_member'"
+
 // GR_GTID_QUERY is a static query to see if the node's GTID exected set
 const GR_GTID_QUERY string = "SELECT @@global.GTID_EXECUTED"
 
@@ -83,44 +98,69 @@ const GR_GTID_SUBSET_QUERY string = "SELECT GTID_SUBTRACT( (SELECT Received_tran
 // GR_GCSADDR_QUERY is a static query to get the GCS address for the node
 const GR_GCSADDR_QUERY string = "SELECT variable_value FROM global_variables WHERE variable_name='group_replication_local_address'"
 
+// GR_FORCE_MEMBERS_QUERY sets the group membership, the list of GCS endpoints being passed as a parameter
+const GR_FORCE_MEMBERS_QUERY string = "SET GLOBAL group_replication_force_members = ?"
+
 func New(myh string, myp string, myu string, mys string) *Node {
 	return &Node{MySQLHost: myh, MySQLPort: myp, MySQLUser: myu, mysqlPass: mys}
 }
 
+// String masks the password, so that a Node can be safely logged
+func (me Node) String() string {
+	// the local type doesn't have the String method, which avoids endless recursion
+	type node Node
+	n := node(me)
+
+	if n.mysqlPass != "" {
+		n.mysqlPass = "********"
+	}
+
+	return fmt.Sprintf("%+v", n)
+}
+
+// logger returns the structured logger with the fields that identify this node
+func (me *Node) logger() *slog.Logger {
+	return Log.With(logging.KeyCluster, me.GroupName, logging.KeyNode, me.MySQLHost+":"+me.MySQLPort, logging.KeyServerUUID, me.ServerUuid)
+}
+
 func (me *Node) Connect() error {
 	var err error
 
+	// a server UUID override can only be matched once we've learned the node's server UUID
+	uuidKnown := me.ServerUuid != ""
+
 	if me.MySQLHost == "" || me.MySQLPort == "" {
 		err = errors.New("No MySQL endpoint specified!")
 	} else {
-		if me.db == nil {
-			connString := me.MySQLUser + ":" + me.mysqlPass + "@tcp(" + me.MySQLHost + ":" + me.MySQLPort + ")/performance_schema"
+		// let's try each of the known credentials in turn, only moving on to the next if the last was rejected
+		candidates := me.credentialCandidates()
 
-			DBCPMutex.Lock()
+		for i, creds := range candidates {
+			err = me.open(creds)
 
-			if dbcp[connString] == nil {
-				if Debug {
-					DebugLog.Printf("Making SQL connection and adding it to the pool using: %s\n", connString)
-				}
-
-				dbcp[connString], err = sql.Open("mysql", connString)
+			if err == nil {
+				err = me.ping()
 			}
 
-			if err != nil {
-				DebugLog.Printf("Error during sql.Open: %v", err)
-			} else {
-				me.db = dbcp[connString]
+			if !IsAuthError(err) {
+				if err == nil && i > 0 {
+					me.logger().Debug("Connected using the previous credentials", "user", creds.User)
+				}
+
+				break
 			}
 
-			DBCPMutex.Unlock()
+			me.logger().Debug("Credentials were rejected", "user", creds.User, logging.KeyError, err)
 		}
 
-		err = me.db.Ping()
+		me.AuthFailed = IsAuthError(err)
+
+		if me.AuthFailed {
+			err = ErrAuthFailed
+		}
 
 		if err == nil {
-			if Debug {
-				DebugLog.Printf("Checking group name on '%s:%s'. Query: %s\n", me.MySQLHost, me.MySQLPort, GR_NAME_QUERY)
-			}
+			me.logger().Debug("Checking group name", "query", GR_NAME_QUERY)
 
 			err = me.db.QueryRow(GR_NAME_QUERY).Scan(&me.GroupName)
 
@@ -129,24 +169,60 @@ func (me *Node) Connect() error {
 			} else if me.GroupName == "" {
 				err = errors.New("Specified MySQL Node is not a member of any Group Replication cluster!")
 			} else {
-				if Debug {
-					DebugLog.Printf("Checking status of '%s:%s'. Query: %s\n", me.MySQLHost, me.MySQLPort, GR_STATUS_QUERY)
-				}
+				me.logger().Debug("Checking status", "query", GR_STATUS_QUERY)
 
 				err = me.db.QueryRow(GR_STATUS_QUERY).Scan(&me.ServerUuid, &me.MemberState)
 			}
 		}
 	}
 
+	// so now that we know it, let's connect again using the node's own credentials
+	if err == nil && !uuidKnown && me.hasUUIDOverride() {
+		me.logger().Debug("Reconnecting using the per-node credentials for the server UUID")
+
+		return me.Connect()
+	}
+
 	return err
 }
 
-func (me *Node) HasQuorum() (bool, error) {
-	if Debug {
-		DebugLog.Printf("Checking if '%s:%s' has a quorum. Query: %s\n", me.MySQLHost, me.MySQLPort, GR_QUORUM_QUERY)
+// open gets the pooled database object for the node using the given credentials
+func (me *Node) open(creds Credentials) error {
+	// JoinHostPort brackets IPv6 addresses, as the DSN requires
+	db, err := DefaultPool.Get(net.JoinHostPort(me.MySQLHost, me.MySQLPort), creds)
+
+	if err == nil {
+		me.db = db
+		me.MySQLUser = creds.User
+		me.mysqlPass = creds.Password
+	}
+
+	return err
+}
+
+// ping checks that the node is still reachable, noting the result so that the pool can track each endpoint's health
+func (me *Node) ping() error {
+	if me.db == nil {
+		return ErrNotConnected
+	}
+
+	// the pool may have closed the database object we were holding, e.g. after it went unused for a while
+	if !DefaultPool.hold(me.db) {
+		if err := me.open(Credentials{User: me.MySQLUser, Password: me.mysqlPass}); err != nil {
+			return err
+		}
 	}
 
 	err := me.db.Ping()
+	DefaultPool.noteResult(me.db, err)
+
+	return err
+}
+
+func (me *Node) HasQuorum() (bool, error) {
+	me.logger().Debug("Checking if the node has a quorum", "query", GR_QUORUM_QUERY)
+
+	err := me.ping()
 
 	if err == nil {
 		err = me.db.QueryRow(GR_QUORUM_QUERY).Scan(&me.Quorum)
@@ -156,11 +232,9 @@ func (me *Node) HasQuorum() (bool, error) {
 }
 
 func (me *Node) MemberStatus() (string, error) {
-	if Debug {
-		DebugLog.Printf("Checking member status of '%s:%s'. Query: %s\n", me.MySQLHost, me.MySQLPort, GR_STATUS_QUERY)
-	}
+	me.logger().Debug("Checking member status", "query", GR_STATUS_QUERY)
 
-	err := me.db.Ping()
+	err := me.ping()
 
 	if err == nil {
 		err = me.db.QueryRow(GR_STATUS_QUERY).Scan(&me.MemberState)
@@ -170,11 +244,9 @@ func (me *Node) MemberStatus() (string, error) {
 }
 
 func (me *Node) IsReadOnly() (bool, error) {
-	if Debug {
-		DebugLog.Printf("Checking if '%s:%s' is read only. Query: %s\n", me.MySQLHost, me.MySQLPort, GR_RO_QUERY)
-	}
+	me.logger().Debug("Checking if the node is read only", "query", GR_RO_QUERY)
 
-	err := me.db.Ping()
+	err := me.ping()
 
 	if err == nil {
 		tmpval := "" // will be set to "ON" or "OFF"
@@ -190,15 +262,27 @@ func (me *Node) IsReadOnly() (bool, error) {
 	return me.ReadOnly, err
 }
 
+// IsPrimary tells us if the node is the primary of a single-primary group, which is the only member taking writes
+func (me *Node) IsPrimary() (bool, error) {
+	me.logger().Debug("Checking if the node is the primary", "query", GR_PRIMARY_QUERY)
+
+	primary := ""
+	err := me.ping()
+
+	if err == nil {
+		err = me.db.QueryRow(GR_PRIMARY_QUERY).Scan(&primary)
+	}
+
+	return err == nil && primary != "" && strings.EqualFold(primary, me.ServerUuid), err
+}
+
 func (me *Node) GetMembers() ([]Node, error) {
 	memberSlice := make([]Node, 0, 3)
 	me.OnlineParticipants = 0
 
-	if Debug {
-		DebugLog.Printf("Getting group members from '%s:%s'. Query: %s\n", me.MySQLHost, me.MySQLPort, GR_MEMBERS_QUERY)
-	}
+	me.logger().Debug("Getting group members", "query", GR_MEMBERS_QUERY)
 
-	err := me.db.Ping()
+	err := me.ping()
 
 	if err == nil {
 		rows, err := me.db.Query(GR_MEMBERS_QUERY)
@@ -207,6 +291,7 @@ func (me *Node) GetMembers() ([]Node, error) {
 			defer rows.Close()
 
 			for rows.Next() {
+				// the member will resolve its own credentials when connecting, if any per-node ones were specified
 				member := New("", "", me.MySQLUser, me.mysqlPass)
 				err = rows.Scan(&member.ServerUuid, &member.MySQLHost, &member.MySQLPort, &member.MemberState)
 				if err == nil {
@@ -219,9 +304,7 @@ func (me *Node) GetMembers() ([]Node, error) {
 
 			rows.Close()
 
-			if Debug {
-				DebugLog.Printf("Group member info found for '%s:%s' -- ONLINE member count: %d, Members: %+v\n", me.MySQLHost, me.MySQLPort, me.OnlineParticipants, memberSlice)
-			}
+			me.logger().Debug("Group member info found", "online_members", me.OnlineParticipants, "members", memberSlice)
 		}
 	}
 
@@ -231,28 +314,18 @@ func (me *Node) GetMembers() ([]Node, error) {
 func (me *Node) Shutdown() error {
 	ShutdownQuery := "SHUTDOWN"
 
-	if Debug {
-		DebugLog.Printf("Shutting down node '%s:%s'\n", me.MySQLHost, me.MySQLPort)
-	}
-
-	err := me.db.Ping()
-
-	if err == nil {
-		_, err = me.db.Exec(ShutdownQuery)
-	}
+	me.logger().Debug("Shutting down node")
 
-	return err
+	return me.execMutation(ShutdownQuery)
 }
 
 func (me *Node) TransactionsExecuted() (string, error) {
 	// since this is such a fast changing metric, I won't cache the value in the struct
 	var gtids string
 
-	if Debug {
-		DebugLog.Printf("Getting the transactions executed on '%s:%s'\n", me.MySQLHost, me.MySQLPort)
-	}
+	me.logger().Debug("Getting the transactions executed")
 
-	err := me.db.Ping()
+	err := me.ping()
 
 	if err == nil {
 		err = me.db.QueryRow(GR_GTID_QUERY).Scan(&gtids)
@@ -268,7 +341,7 @@ func (me *Node) TransactionsExecutedCount() (uint64, error) {
 
 	GTIDSet, err = me.TransactionsExecuted()
 
-	if err != nil {
+	if err == nil {
 		cnt, err = TransactionCount(GTIDSet)
 	}
 
@@ -280,17 +353,18 @@ func (me *Node) ApplierQueueLength() (uint64, error) {
 	var qlen uint64
 	var GTIDSubset string
 
-	if Debug {
-		DebugLog.Printf("Getting the applier queue length on '%s:%s'\n", me.MySQLHost, me.MySQLPort)
-	}
+	me.logger().Debug("Getting the applier queue length")
 
-	err := me.db.Ping()
+	err := me.ping()
 
 	if err == nil {
 		err = me.db.QueryRow(GR_GTID_SUBSET_QUERY).Scan(&GTIDSubset)
 	}
 
-	qlen, err = TransactionCount(GTIDSubset)
+	// we can't let a successful count of an empty set hide the error from the query
+	if err == nil {
+		qlen, err = TransactionCount(GTIDSubset)
+	}
 
 	return qlen, err
 }
@@ -315,9 +389,7 @@ func TransactionCount(GTIDSet string) (uint64, error) {
 	var secondval uint64
 	var nextval uint64
 
-	if Debug {
-		DebugLog.Printf("Calculating total number of GTIDs from a set of: %s\n", GTIDSet)
-	}
+	Log.Debug("Calculating total number of GTIDs", "gtid_set", GTIDSet)
 
 	for colonPos != -1 {
 		// lets get rid of everything before the current colon, and the colon itself, as it's UUID info that we don't care about
@@ -365,55 +437,58 @@ func TransactionCount(GTIDSet string) (uint64, error) {
 			break
 		}
 
-		if Debug {
-			DebugLog.Printf("The current calculation is: (%d - %d)\n", secondval, firstval)
-			DebugLog.Printf("Current total: %d, adding %d\n", GTIDCount, nextval)
-		}
+		Log.Debug("Adding the GTID interval", "end", secondval, "start", firstval, "total", GTIDCount, "adding", nextval)
 
 		GTIDCount = GTIDCount + nextval
 
 		colonPos = strings.IndexRune(GTIDSet, ':')
 
-		if Debug {
-			DebugLog.Printf("Remaining unprocessed GTID string: %s\n", GTIDSet)
-		}
+		Log.Debug("Remaining unprocessed GTID string", "gtid_set", GTIDSet)
 	}
 
 	return GTIDCount, err
 }
 
-func (me *Node) GetGCSAddress() (string, error) {
+// GetGCSEndpoint returns the validated GCS/XCom endpoint for the node, a *GCSEndpointError when it's not valid
+func (me *Node) GetGCSEndpoint() (GCSEndpoint, error) {
 	var GCSAddr string
 
-	if Debug {
-		DebugLog.Printf("Getting GCS endpoint for '%s:%s'. Query: %s\n", me.MySQLHost, me.MySQLPort, GR_GCSADDR_QUERY)
-	}
+	me.logger().Debug("Getting GCS endpoint", "query", GR_GCSADDR_QUERY)
 
-	err := me.db.Ping()
+	err := me.ping()
 
 	if err == nil {
 		err = me.db.QueryRow(GR_GCSADDR_QUERY).Scan(&GCSAddr)
 	}
 
-	return GCSAddr, err
+	if err != nil {
+		return GCSEndpoint{}, err
+	}
+
+	return ParseGCSEndpoint(GCSAddr)
 }
 
-func (me *Node) ForceMembers(fms string) error {
-	forceMembershipQuery := "SET GLOBAL group_replication_force_members='" + fms + "'"
+// ForceMembers validates the endpoints, see ValidateGCSEndpoints, and then forces the group membership to them
+func (me *Node) ForceMembers(endpoints []GCSEndpoint) error {
+	if len(endpoints) == 0 {
+		return errors.New("No GCS endpoints to force the group membership to!")
+	}
 
-	if Debug {
-		DebugLog.Printf("Forcing group membership on '%s:%s'. Query: %s\n", me.MySQLHost, me.MySQLPort, forceMembershipQuery)
+	// the caller has already dialed them with ValidateGCSEndpoints, so we only make sure that they're well formed
+	if err := CheckGCSEndpoints(endpoints); err != nil {
+		return err
 	}
 
-	err := me.db.Ping()
+	fms := ForceMembersValue(endpoints)
 
-	if err == nil {
-		_, err = me.db.Exec(forceMembershipQuery)
-	}
+	me.logger().Debug("Forcing group membership", "query", GR_FORCE_MEMBERS_QUERY, "force_members", fms)
+
+	// the value is passed as a parameter, rather than being quoted into the statement
+	err := me.execMutation(GR_FORCE_MEMBERS_QUERY, fms)
 
 	// now that we've forced the membership, let's reset the global variable (otherwise it will cause complications later)
 	if err == nil {
-		_, err = me.db.Exec("SET GLOBAL group_replication_force_members=''")
+		err = me.execMutation(GR_FORCE_MEMBERS_QUERY, "")
 	}
 
 	return err
@@ -428,20 +503,24 @@ func (me *Node) SetReadOnly(ro bool) error {
 		ROQuery = ROQuery + "OFF"
 	}
 
-	if Debug {
-		DebugLog.Printf("Setting read_only mode to %t on '%s:%s'\n", ro, me.MySQLHost, me.MySQLPort)
-	}
+	me.logger().Debug("Setting read_only mode", "read_only", ro)
 
-	err := me.db.Ping()
+	err := me.execMutation(ROQuery)
 
 	if err == nil {
-		_, err = me.db.Exec(ROQuery)
 		me.ReadOnly = ro
 	}
 
 	return err
 }
 
+// StopGroupReplication has the node leave the group, the group then carries on without it
+func (me *Node) StopGroupReplication() error {
+	me.logger().Debug("Stopping Group Replication")
+
+	return me.execMutation("STOP GROUP_REPLICATION")
+}
+
 func (me *Node) SetOfflineMode(om bool) error {
 	OMQuery := "SET GLOBAL offline_mode="
 
@@ -451,27 +530,51 @@ func (me *Node) SetOfflineMode(om bool) error {
 		OMQuery = OMQuery + "OFF"
 	}
 
-	if Debug {
-		DebugLog.Printf("Setting offline mode to %t on '%s:%s'\n", om, me.MySQLHost, me.MySQLPort)
-	}
+	me.logger().Debug("Setting offline mode", "offline_mode", om)
 
-	err := me.db.Ping()
+	return me.execMutation(OMQuery)
+}
+
+// execMutation executes a statement that changes the state of the node, letting the Auditor know about it
+func (me *Node) execMutation(statement string, args ...interface{}) error {
+	err := me.ping()
 
 	if err == nil {
-		_, err = me.db.Exec(OMQuery)
+		if Audit != nil {
+			Audit.Attempt(me, auditStatement(statement, args))
+		}
+
+		_, err = me.db.Exec(statement, args...)
+	}
+
+	if Audit != nil {
+		Audit.Mutation(me, auditStatement(statement, args), err)
 	}
 
 	return err
 }
 
+// auditStatement is the statement as it's recorded by the Auditor, with the values of any parameters filled in
+func auditStatement(statement string, args []interface{}) string {
+	for _, arg := range args {
+		value := fmt.Sprint(arg)
+
+		if s, ok := arg.(string); ok {
+			value = "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+		}
+
+		statement = strings.Replace(statement, "?", value, 1)
+	}
+
+	return statement
+}
+
 func (me *Node) Cleanup() error {
 	var err error = nil
 
-	if Debug {
-		DebugLog.Printf("Cleaning up Node object for '%s:%s'\n", me.MySQLHost, me.MySQLPort)
-	}
+	me.logger().Debug("Cleaning up Node object")
 
-	// We don't want to close this anymore as it's a pointer to a connection in our pool now
+	// We don't want to close this anymore as it's a pointer to a connection in our pool now, which is managed by the Pool
 	/*
 	  if( me.db != nil ){
 	    err = me.db.Close()
@@ -484,9 +587,7 @@ func (me *Node) Cleanup() error {
 func (me *Node) Reset() {
 	_ = me.Cleanup()
 
-	if Debug {
-		DebugLog.Printf("Resetting Node object for '%s:%s'\n", me.MySQLHost, me.MySQLPort)
-	}
+	me.logger().Debug("Resetting Node object")
 
 	me.MySQLHost = ""
 	me.MySQLPort = ""
@@ -498,5 +599,7 @@ func (me *Node) Reset() {
 	me.OnlineParticipants = 0
 	me.Quorum = false
 	me.ReadOnly = false
+	me.Label = ""
+	me.AuthFailed = false
 	me.db = nil
 }
@@ -0,0 +1,80 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package group_test
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"github.com/mattlord/myarbitratord/replication/group"
+	"github.com/mattlord/myarbitratord/replication/group/grouptest"
+)
+
+func init() {
+	group.DriverName = grouptest.DriverName
+}
+
+// addMember starts the stand-in for an ONLINE member of the group, which has executed the GTID set
+func addMember(endpoint string, uuid string, gtids string) *grouptest.Member {
+	return grouptest.Add(endpoint).
+		Returns(group.GR_NAME_QUERY, []driver.Value{"550fa9ee-a1f8-4b6d-9bfe-c03c12cd1c72"}).
+		Returns(group.GR_STATUS_QUERY, []driver.Value{uuid, "ONLINE"}).
+		Returns(group.GR_GTID_QUERY, []driver.Value{gtids})
+}
+
+func TestTransactionsExecutedCount(t *testing.T) {
+	defer grouptest.Reset()
+
+	tests := []struct {
+		name    string
+		gtids   string
+		down    bool
+		want    uint64
+		wantErr bool
+	}{
+		{name: "one interval", gtids: "550fa9ee-a1f8-4b6d-9bfe-c03c12cd1c72:1-1042", want: 1042},
+		{name: "several UUIDs and intervals", gtids: "550fa9ee-a1f8-4b6d-9bfe-c03c12cd1c72:1-10:20-29,\n3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5", want: 25},
+		{name: "nothing executed", gtids: "", want: 0},
+		{name: "mysqld is down", down: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grouptest.Reset()
+
+			if !tt.down {
+				addMember("hanode1:3306", "uuid-1", tt.gtids)
+			}
+
+			node := group.New("hanode1", "3306", "root", "")
+			err := node.Connect()
+
+			if err == nil {
+				var count uint64
+				count, err = node.TransactionsExecutedCount()
+
+				if count != tt.want {
+					t.Errorf("TransactionsExecutedCount() = %d, want %d", count, tt.want)
+				}
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want an error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package group
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattlord/myarbitratord/logging"
+)
+
+// ErrPoolClosed is returned when trying to get a database object from a Pool that has been closed
+var ErrPoolClosed = errors.New("The connection pool has been closed!")
+
+// retireGrace is how long a retired database object must go unused before it's closed
+const retireGrace = time.Minute
+
+// Pool owns the database objects for each of the mysqld endpoints that we talk to, one per endpoint and account
+type Pool struct {
+	// MaxOpen and MaxIdle limit the connections for each endpoint, 0 means no limit for MaxOpen
+	MaxOpen int
+	MaxIdle int
+	// IdleTimeout is how long an endpoint can go unused before we close it, e.g. after the member left the group
+	IdleTimeout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*poolEntry
+	/*
+	  The database objects that Get no longer hands out, e.g. as their credentials were rotated, but that a Node may
+	  still hold. They're only closed by EvictIdle once they've gone unused for retireGrace with no connections in
+	  use, so that we never close a database object out from under an in-flight query.
+	*/
+	retired []*poolEntry
+	closed  bool
+}
+
+type poolEntry struct {
+	db       *sql.DB
+	endpoint string
+	creds    Credentials
+	created  time.Time
+	lastUsed time.Time
+	// the health of the endpoint, based on the last time that we used it
+	lastErr  error
+	failures uint
+}
+
+// PoolStats is the state of one pooled endpoint, presented as JSON via the "/stats" HTTP API call
+type PoolStats struct {
+	Endpoint            string `json:"Endpoint"`
+	User                string `json:"User"`
+	Healthy             bool   `json:"Healthy"`
+	LastError           string `json:"Last Error,omitempty"`
+	ConsecutiveFailures uint   `json:"Consecutive Failures,omitempty"`
+	Created             string `json:"Created"`
+	LastUsed            string `json:"Last Used"`
+	OpenConnections     int    `json:"Open Connections"`
+	InUse               int    `json:"In Use"`
+	Idle                int    `json:"Idle"`
+}
+
+/*
+The timeouts for connecting to a mysqld, and for reading and writing once connected. They must be well within the
+arbitrator's health check limit, as otherwise an unreachable member, which only times out at the TCP level after
+minutes, would have systemd's watchdog kill us while we're handling the partition.
+*/
+var (
+	ConnectTimeout = 2 * time.Second
+	IOTimeout      = 5 * time.Second
+)
+
+/*
+StepTimeout is the longest that we can spend on one member when every wait times out: connecting to it, reading the
+handshake and the ping, its group name and status, its quorum, and the result of the action that we take on it.
+*/
+func StepTimeout() time.Duration {
+	return ConnectTimeout + 6*IOTimeout
+}
+
+// DriverName is the database/sql driver that each endpoint is opened with, see the grouptest package for testing
+var DriverName = "mysql"
+
+// DefaultPool is the pool used by all Nodes
+var DefaultPool = NewPool(2, 1, 10*time.Minute)
+
+func NewPool(maxOpen int, maxIdle int, idleTimeout time.Duration) *Pool {
+	return &Pool{MaxOpen: maxOpen, MaxIdle: maxIdle, IdleTimeout: idleTimeout, entries: make(map[string]*poolEntry)}
+}
+
+// Get returns the database object for the 'host:port' endpoint and account, opening it if needed
+func (p *Pool) Get(endpoint string, creds Credentials) (*sql.DB, error) {
+	connString := creds.User + ":" + creds.Password + "@tcp(" + endpoint + ")/performance_schema?timeout=" + ConnectTimeout.String() + "&readTimeout=" + IOTimeout.String() + "&writeTimeout=" + IOTimeout.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	entry := p.entries[connString]
+
+	if entry == nil {
+		// never log the password, only the endpoint and user
+		Log.Debug("Making SQL connection and adding it to the pool", logging.KeyNode, endpoint, "user", creds.User)
+
+		db, err := sql.Open(DriverName, connString)
+
+		if err != nil {
+			Log.Error("Error during sql.Open", logging.KeyNode, endpoint, logging.KeyError, err)
+			return nil, err
+		}
+
+		db.SetMaxOpenConns(p.MaxOpen)
+		db.SetMaxIdleConns(p.MaxIdle)
+
+		entry = &poolEntry{db: db, endpoint: endpoint, creds: creds, created: time.Now()}
+		p.entries[connString] = entry
+	}
+
+	entry.lastUsed = time.Now()
+
+	return entry.db, nil
+}
+
+// find returns the active or retired entry for the database object, nil when it's been closed
+func (p *Pool) find(db *sql.DB) *poolEntry {
+	for _, entry := range p.entries {
+		if entry.db == db {
+			return entry
+		}
+	}
+
+	for _, entry := range p.retired {
+		if entry.db == db {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// noteResult records the health of the endpoint based on the result of the last operation on it
+func (p *Pool) noteResult(db *sql.DB, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if entry := p.find(db); entry != nil {
+		entry.lastUsed = time.Now()
+		entry.lastErr = err
+
+		if err == nil {
+			entry.failures = 0
+		} else {
+			entry.failures++
+		}
+	}
+}
+
+// hold tells us if the database object is still open, noting that it's being used so that it stays open for now
+func (p *Pool) hold(db *sql.DB) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry := p.find(db)
+
+	if entry != nil {
+		entry.lastUsed = time.Now()
+	}
+
+	return entry != nil
+}
+
+// retire stops handing out the entry's database object, it's closed by EvictIdle once no one is using it
+func (p *Pool) retire(connString string, entry *poolEntry) {
+	delete(p.entries, connString)
+	p.retired = append(p.retired, entry)
+}
+
+/*
+EvictIdle retires the endpoints that haven't been used within the IdleTimeout, and closes the retired database objects
+that are no longer being used. It returns how many endpoints were retired.
+*/
+func (p *Pool) EvictIdle() int {
+	evicted := 0
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.IdleTimeout > 0 {
+		for connString, entry := range p.entries {
+			if time.Since(entry.lastUsed) > p.IdleTimeout {
+				Log.Debug("Retiring idle pooled connection", logging.KeyNode, entry.endpoint)
+
+				p.retire(connString, entry)
+				evicted++
+			}
+		}
+	}
+
+	retired := p.retired[:0]
+
+	for _, entry := range p.retired {
+		if time.Since(entry.lastUsed) > retireGrace && entry.db.Stats().InUse == 0 {
+			Log.Debug("Closing retired pooled connection", logging.KeyNode, entry.endpoint, "user", entry.creds.User)
+
+			entry.db.Close()
+		} else {
+			retired = append(retired, entry)
+		}
+	}
+
+	p.retired = retired
+
+	return evicted
+}
+
+// Evict retires all of the database objects for the 'host:port' endpoint
+func (p *Pool) Evict(endpoint string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for connString, entry := range p.entries {
+		if entry.endpoint == endpoint {
+			p.retire(connString, entry)
+		}
+	}
+}
+
+// retainCredentials retires the database objects using credentials that aren't in the active list
+func (p *Pool) retainCredentials(active []Credentials) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for connString, entry := range p.entries {
+		inUse := false
+
+		for _, creds := range active {
+			if entry.creds == creds {
+				inUse = true
+				break
+			}
+		}
+
+		if inUse {
+			continue
+		}
+
+		Log.Debug("Retiring pooled connection using stale credentials", logging.KeyNode, entry.endpoint, "user", entry.creds.User)
+
+		p.retire(connString, entry)
+	}
+}
+
+// Stats returns the state of each pooled endpoint, ordered by endpoint
+func (p *Pool) Stats() []PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]PoolStats, 0, len(p.entries))
+
+	for _, entry := range p.entries {
+		dbStats := entry.db.Stats()
+		stat := PoolStats{
+			Endpoint:            entry.endpoint,
+			User:                entry.creds.User,
+			Healthy:             entry.lastErr == nil,
+			ConsecutiveFailures: entry.failures,
+			Created:             entry.created.Format(time.RFC1123),
+			LastUsed:            entry.lastUsed.Format(time.RFC1123),
+			OpenConnections:     dbStats.OpenConnections,
+			InUse:               dbStats.InUse,
+			Idle:                dbStats.Idle,
+		}
+
+		if entry.lastErr != nil {
+			stat.LastError = entry.lastErr.Error()
+		}
+
+		stats = append(stats, stat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Endpoint == stats[j].Endpoint {
+			return stats[i].User < stats[j].User
+		}
+		return stats[i].Endpoint < stats[j].Endpoint
+	})
+
+	return stats
+}
+
+// Close closes all of the pooled database objects, after which the pool can no longer be used
+func (p *Pool) Close() error {
+	var err error
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for connString, entry := range p.entries {
+		if cerr := entry.db.Close(); cerr != nil {
+			err = cerr
+		}
+
+		delete(p.entries, connString)
+	}
+
+	for _, entry := range p.retired {
+		if cerr := entry.db.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+
+	p.retired = nil
+	p.closed = true
+
+	return err
+}
@@ -0,0 +1,141 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/mattlord/myarbitratord/discovery"
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// errNoSeed is returned when none of the candidates could be used as the seed node
+var errNoSeed = errors.New("None of the candidate seed nodes is an ONLINE member of the group!")
+
+// seedSource is where we find the seed nodes, beyond the last known membership view
+type seedSource struct {
+	// the seed nodes from -seed-host and -seed-file
+	static []discovery.Endpoint
+	// srv is the DNS SRV record listing the seed nodes
+	srv string
+	// expandDNS replaces each seed hostname with all of its A/AAAA records
+	expandDNS bool
+	// parallel connects to all of the candidates at once, rather than one at a time in order
+	parallel bool
+	user     string
+	password string
+}
+
+var seeds seedSource
+
+// resolve returns the seed nodes, doing any DNS lookups again each time as the records may have changed
+func (me *seedSource) resolve() []discovery.Endpoint {
+	endpoints := append([]discovery.Endpoint{}, me.static...)
+
+	if me.srv != "" {
+		srvEndpoints, err := discovery.LookupSRV(me.srv)
+
+		if err != nil {
+			Log.Warn("Could not look up the seed nodes in the DNS SRV record", "srv", me.srv, logging.KeyError, err)
+		}
+
+		endpoints = append(endpoints, srvEndpoints...)
+	}
+
+	if me.expandDNS {
+		return discovery.ExpandHosts(endpoints)
+	}
+
+	return discovery.Dedupe(endpoints)
+}
+
+// candidates returns the nodes to try when the current seed node can't be used: the members in the last known
+// membership view, followed by the seed nodes that we were configured with
+func (me *seedSource) candidates(current group.Node, lastView []group.Node) []group.Node {
+	var nodes []group.Node
+
+	known := map[string]bool{current.MySQLHost + ":" + current.MySQLPort: true}
+
+	for _, node := range lastView {
+		if node != current {
+			nodes = append(nodes, node)
+		}
+
+		known[node.MySQLHost+":"+node.MySQLPort] = true
+	}
+
+	for _, endpoint := range me.resolve() {
+		if !known[endpoint.Host+":"+endpoint.Port] {
+			nodes = append(nodes, *group.New(endpoint.Host, endpoint.Port, me.user, me.password))
+			known[endpoint.Host+":"+endpoint.Port] = true
+		}
+	}
+
+	return nodes
+}
+
+// findSeed connects to the candidates, one at a time in order or all at once, and returns the first one found
+// that's an ONLINE member of the group
+func findSeed(logger *slog.Logger, candidates []group.Node, parallel bool) (group.Node, error) {
+	if !parallel {
+		for i := range candidates {
+			if tryCandidate(logger, &candidates[i]) {
+				return candidates[i], nil
+			}
+		}
+
+		return group.Node{}, errNoSeed
+	}
+
+	// the channel is buffered, so the stragglers can finish after we've returned
+	results := make(chan *group.Node, len(candidates))
+
+	for i := range candidates {
+		go func(node *group.Node) {
+			if tryCandidate(logger, node) {
+				results <- node
+			} else {
+				results <- nil
+			}
+		}(&candidates[i])
+	}
+
+	for range candidates {
+		if node := <-results; node != nil {
+			return *node, nil
+		}
+	}
+
+	return group.Node{}, errNoSeed
+}
+
+// tryCandidate tells us if the node can be used as the seed node
+func tryCandidate(logger *slog.Logger, node *group.Node) bool {
+	err := node.Connect()
+	noteConnectResult(node, err)
+
+	if err == nil && node.MemberState == "ONLINE" {
+		return true
+	}
+
+	nodeLogger(logger, node).Debug("Can't use the node as the seed node", "member_state", node.MemberState, logging.KeyError, err)
+	node.Cleanup()
+
+	return false
+}
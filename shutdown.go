@@ -0,0 +1,97 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// The exit codes, so that a supervisor or operator can tell why we stopped
+const (
+	exitOK          = 0
+	exitConfigError = 1
+	// exitMonitorFailed means that we could no longer monitor the cluster, e.g. as the audit log can't be written
+	exitMonitorFailed = 100
+	// exitShutdownTimeout means that an action was still in flight when the shutdown timeout expired
+	exitShutdownTimeout = 101
+	// exitForcedShutdown means that a second signal forced us to exit without waiting for the in-flight action
+	exitForcedShutdown = 102
+)
+
+/*
+handleSignals cancels the context on SIGTERM or SIGINT, so that MonitorCluster doesn't start any new decisions. Any
+action already in flight, e.g. forcing the membership or fencing the nodes, is given until the timeout to complete. If
+it doesn't, or we get a second signal, then we note what was in flight and exit right away. The stopped channel is
+closed once MonitorCluster has returned, after which main handles the rest of the shutdown.
+*/
+func handleSignals(cancel context.CancelFunc, stopped <-chan struct{}, timeout time.Duration) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	var sig os.Signal
+
+	select {
+	case sig = <-sigs:
+	case <-stopped:
+		signal.Stop(sigs)
+		return
+	}
+
+	Log.Info("Shutting down, no new decisions will be made", "signal", sig.String(), "timeout", timeout)
+	notifyStopping()
+	cancel()
+
+	if fields, ok := auditor.inFlight(); ok {
+		Log.Warn("Waiting for the in-flight action to complete before shutting down", fields...)
+	}
+
+	exitCode := exitShutdownTimeout
+	msg := "Timed out waiting for the in-flight action to complete, exiting anyway"
+
+	select {
+	case <-stopped:
+		// from here on a second signal will simply kill us
+		signal.Stop(sigs)
+		return
+	case sig = <-sigs:
+		exitCode = exitForcedShutdown
+		msg = "Received a second " + sig.String() + " signal, exiting immediately"
+	case <-time.After(timeout):
+	}
+
+	fields, _ := auditor.inFlight()
+	Log.Error(msg, fields...)
+
+	// the audit log is synced after every record, so let's only try to close what's left
+	auditor.close()
+	os.Exit(exitCode)
+}
+
+// sleepContext sleeps for the duration, returning early if the context is cancelled
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,541 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// The overall decisions for a simulated cluster
+const (
+	simNoSeed       = "no_seed"
+	simNoAction     = "no_action"
+	simActOnMembers = "act_on_members"
+	simNewSeed      = "use_new_seed"
+	simForce        = "force_members"
+	simRefused      = "refused"
+	simBlocked      = "blocked"
+)
+
+// simMember is one member of a hypothetical cluster, for the "/simulate" HTTP API call and the simulate command
+type simMember struct {
+	Host       string `json:"host"`
+	Port       string `json:"port"`
+	ServerUUID string `json:"server_uuid"`
+	// State is the member's state as it sees itself, ONLINE when not given
+	State string `json:"state"`
+	// Reachable is if we can connect to the member's mysqld, true when not given
+	Reachable *bool `json:"reachable"`
+	// Sees is the state that the member sees each member in, by 'host:port', i.e. its replication_group_members.
+	// When not given it sees each member in the state that member sees itself in.
+	Sees         map[string]string `json:"sees"`
+	GTIDExecuted string            `json:"gtid_executed"`
+	// GCSAddress is the member's group_replication_local_address, MySQL Shell's default when not given, see defaultGCSAddress
+	GCSAddress string `json:"gcs_address"`
+	// Quorum is if the member thinks that it has a quorum, when not given it has one if a majority of its view is ONLINE
+	Quorum *bool `json:"quorum,omitempty"`
+	// Error is what went wrong when the member was observed, it's only informative
+	Error string `json:"error,omitempty"`
+}
+
+// simCluster is a hypothetical cluster, as we'd observe it
+type simCluster struct {
+	Cluster string `json:"cluster"`
+	// Seed is the 'host:port' of our current seed node, the first reachable ONLINE member when not given
+	Seed    string      `json:"seed"`
+	Members []simMember `json:"members"`
+	// MinOnlineMembers overrides -min-online-members
+	MinOnlineMembers int `json:"min_online_members"`
+}
+
+// simAction is an action that we'd take
+type simAction struct {
+	Action string `json:"action"`
+	Node   string `json:"node"`
+	Reason string `json:"reason"`
+	// Refused is why the action wouldn't be taken after all, e.g. by the quorum guard
+	Refused string `json:"refused,omitempty"`
+}
+
+// simResult is the decision that we'd make for a hypothetical cluster, and why
+type simResult struct {
+	Decision     string           `json:"decision"`
+	Seed         string           `json:"seed,omitempty"`
+	SeedQuorum   bool             `json:"seed_has_quorum"`
+	Partitions   []reachPartition `json:"partitions"`
+	Isolated     []string         `json:"isolated,omitempty"`
+	ForceMembers string           `json:"force_members,omitempty"`
+	Actions      []simAction      `json:"actions"`
+	Reasons      []string         `json:"reasons"`
+	Matrix       string           `json:"matrix"`
+}
+
+func (r *simResult) because(format string, args ...interface{}) {
+	r.Reasons = append(r.Reasons, fmt.Sprintf(format, args...))
+}
+
+/*
+simulate returns the decision that we'd make for the hypothetical cluster, using the same decisions as MonitorCluster,
+without touching any server. It's a single loop's worth of decisions, with none of the state that the daemon carries
+from one loop to the next, e.g. a forced membership awaiting approval, the circuit breaker, or FAILED_RECOVERY.
+*/
+func simulate(cluster simCluster) (simResult, error) {
+	result := simResult{Actions: []simAction{}, Reasons: []string{}}
+
+	if len(cluster.Members) == 0 {
+		return result, errors.New("no members were given")
+	}
+
+	minOnline := minOnlineMembers
+
+	if cluster.MinOnlineMembers > 0 {
+		minOnline = cluster.MinOnlineMembers
+	}
+
+	// the members as we'd see them, by 'host:port'
+	nodes := make([]group.Node, len(cluster.Members))
+	index := make(map[string]int)
+
+	for i := range cluster.Members {
+		m := &cluster.Members[i]
+
+		if m.Host == "" {
+			return result, fmt.Errorf("member %d has no host", i+1)
+		}
+
+		if m.Port == "" {
+			m.Port = "3306"
+		}
+
+		if m.State == "" {
+			m.State = "ONLINE"
+		}
+
+		key := m.Host + ":" + m.Port
+
+		if _, dup := index[key]; dup {
+			return result, fmt.Errorf("member %s is listed more than once", key)
+		}
+
+		index[key] = i
+
+		// the server UUID is only used to tell the members apart
+		uuid := m.ServerUUID
+
+		if uuid == "" {
+			uuid = key
+		}
+
+		nodes[i] = group.Node{MySQLHost: m.Host, MySQLPort: m.Port, ServerUuid: uuid, MemberState: m.State, GroupName: cluster.Cluster}
+	}
+
+	reachable := func(i int) bool {
+		return cluster.Members[i].Reachable == nil || *cluster.Members[i].Reachable
+	}
+
+	// each reachable member's own view of the group
+	views := make([][]group.Node, len(nodes))
+
+	for i, m := range cluster.Members {
+		if !reachable(i) {
+			continue
+		}
+
+		sees := m.Sees
+
+		if len(sees) == 0 {
+			sees = make(map[string]string)
+
+			for j, other := range cluster.Members {
+				sees[nodes[j].MySQLHost+":"+nodes[j].MySQLPort] = other.State
+			}
+		}
+
+		// a member always lists itself
+		if _, ok := sees[m.Host+":"+m.Port]; !ok {
+			sees[m.Host+":"+m.Port] = m.State
+		}
+
+		for j := range nodes {
+			if state, ok := sees[nodes[j].MySQLHost+":"+nodes[j].MySQLPort]; ok {
+				seen := nodes[j]
+				seen.MemberState = state
+				views[i] = append(views[i], seen)
+			}
+		}
+
+		for key := range sees {
+			if _, ok := index[key]; !ok {
+				return result, fmt.Errorf("member %s:%s sees %s, which isn't one of the members", m.Host, m.Port, key)
+			}
+		}
+
+		nodes[i].OnlineParticipants = 0
+
+		for _, seen := range views[i] {
+			if seen.MemberState == "ONLINE" {
+				nodes[i].OnlineParticipants++
+			}
+		}
+	}
+
+	hasQuorum := func(i int) bool {
+		if !reachable(i) || nodes[i].MemberState != "ONLINE" {
+			return false
+		}
+
+		if q := cluster.Members[i].Quorum; q != nil {
+			return *q
+		}
+
+		return viewHasQuorum(views[i])
+	}
+
+	matrix := newReachabilityMatrix(nodes, views)
+	result.Partitions = matrix.Partitions
+	result.Isolated = matrix.Isolated
+	result.Matrix = matrix.ASCII()
+
+	// the seed node has to be reachable and ONLINE, otherwise we'd find a new one
+	seed := -1
+
+	if i, ok := index[cluster.Seed]; ok && reachable(i) && nodes[i].MemberState == "ONLINE" {
+		seed = i
+	} else {
+		if cluster.Seed != "" {
+			result.because("The seed node %s can't be used, as it's not one of the reachable ONLINE members", cluster.Seed)
+		}
+
+		for i := range nodes {
+			if reachable(i) && nodes[i].MemberState == "ONLINE" {
+				seed = i
+				break
+			}
+		}
+	}
+
+	if seed < 0 {
+		result.Decision = simNoSeed
+		result.because("No valid seed node could be found, as none of the members is both reachable and ONLINE")
+		return result, nil
+	}
+
+	seedNode := nodes[seed]
+	members := views[seed]
+	result.Seed = seedNode.MySQLHost + ":" + seedNode.MySQLPort
+	result.SeedQuorum = hasQuorum(seed)
+
+	if result.SeedQuorum {
+		result.Decision = simNoAction
+		result.because("The seed node %s has a quorum, with %d of the %d members it sees ONLINE", result.Seed, seedNode.OnlineParticipants, len(members))
+
+		for i := range nodes {
+			if i == seed {
+				continue
+			}
+
+			name := nodes[i].MySQLHost + ":" + nodes[i].MySQLPort
+
+			if !reachable(i) {
+				result.because("%s can't be reached, so there's nothing we can do with it", name)
+				continue
+			}
+
+			action, reason := memberAction(nodes[i].MemberState, hasQuorum(i))
+
+			if action == decideNone {
+				continue
+			}
+
+			act := simAction{Action: action, Node: name, Reason: reason}
+
+			if action == decideShutdown {
+				if err := guardMembership("Shutting down "+name, members, minOnline, nodes[i]); err != nil {
+					act.Refused = err.Error()
+				}
+			}
+
+			result.Decision = simActOnMembers
+			result.Actions = append(result.Actions, act)
+		}
+
+		return result, nil
+	}
+
+	result.because("The seed node %s has lost its quorum, with %d of the %d members it sees ONLINE, so there's a network partition", result.Seed, seedNode.OnlineParticipants, len(members))
+
+	for i := range nodes {
+		if hasQuorum(i) {
+			result.Decision = simNewSeed
+			result.because("The partition of %s:%s still has a quorum, so it becomes the seed node and nothing is forced", nodes[i].MySQLHost, nodes[i].MySQLPort)
+			return result, nil
+		}
+	}
+
+	gtidCount := func(node group.Node) uint64 {
+		count, _ := group.TransactionCount(cluster.Members[index[node.MySQLHost+":"+node.MySQLPort]].GTIDExecuted)
+		return count
+	}
+
+	candidateNode, ok := forceCandidate(Log, matrix, members, gtidCount)
+
+	if !ok || !reachable(index[candidateNode.MySQLHost+":"+candidateNode.MySQLPort]) {
+		result.Decision = simBlocked
+		result.because("No partition has a quorum, and none of the partitions has a member that we can reach")
+		return result, nil
+	}
+
+	candidate := index[candidateNode.MySQLHost+":"+candidateNode.MySQLPort]
+	result.because("No partition has a quorum, so the partition of %s:%s is chosen as the new primary one, being the largest (or having the most GTIDs)", candidateNode.MySQLHost, candidateNode.MySQLPort)
+
+	// what we'd observe of each member in the candidate's view
+	var observed []forceObservation
+
+	for _, seen := range views[candidate] {
+		i := index[seen.MySQLHost+":"+seen.MySQLPort]
+		o := forceObservation{Node: nodes[i], Reached: reachable(i), Seen: seen.MemberState}
+
+		if o.Reached && o.Node.MemberState == "ONLINE" {
+			addr := cluster.Members[i].GCSAddress
+
+			if addr == "" {
+				addr, o.EndpointErr = defaultGCSAddress(nodes[i].MySQLHost, nodes[i].MySQLPort)
+			}
+
+			if o.EndpointErr == nil {
+				o.Endpoint, o.EndpointErr = group.ParseGCSEndpoint(addr)
+			}
+		}
+
+		observed = append(observed, o)
+	}
+
+	decision := decideForce(observed, minOnline)
+	result.ForceMembers = decision.ForceMembers
+
+	for _, o := range decision.Excluded {
+		result.because("%s:%s is left out of the forced membership, as: %v", o.Node.MySQLHost, o.Node.MySQLPort, o.EndpointErr)
+	}
+
+	if decision.Blocked == errNoForceMembers {
+		result.Decision = simBlocked
+		result.because("No valid group membership to force, the group remains blocked")
+		return result, nil
+	}
+
+	if decision.Blocked != nil {
+		result.Decision = simBlocked
+		result.because("Not forcing the membership, the group remains blocked: %v", decision.Blocked)
+		return result, nil
+	}
+
+	force := simAction{Action: decideForceMembers, Node: candidateNode.MySQLHost + ":" + candidateNode.MySQLPort, Reason: "No partition has a quorum, forcing the membership of the partition with the most online members (or the most GTIDs)"}
+	result.Decision = simForce
+
+	if decision.Refused != nil {
+		force.Refused = decision.Refused.Error()
+		result.Decision = simRefused
+	}
+
+	result.Actions = append(result.Actions, force)
+
+	if forceConfirmDelay > 0 || forceApproval {
+		result.because("The forced membership would first be confirmed after -force-confirm-delay (%s), or approved with -force-approval (%t)", forceConfirmDelay, forceApproval)
+	}
+
+	if force.Refused != "" {
+		return result, nil
+	}
+
+	result.because("Once the forced members are ONLINE with a quorum, the members left out of the forced membership are fenced")
+
+	for i, loser := range decision.Losing {
+		name := loser.MySQLHost + ":" + loser.MySQLPort
+		act := simAction{Action: decideShutdown, Node: name, Reason: "The node was left out of the forced primary partition"}
+
+		if err := decision.Unfenced[i]; err != nil {
+			act.Refused = err.Error()
+		} else if !reachable(index[name]) {
+			act.Refused = "the node can't be reached"
+		}
+
+		result.Actions = append(result.Actions, act)
+	}
+
+	return result, nil
+}
+
+/*
+defaultGCSAddress is the GCS address that MySQL Shell gives a member by default, its MySQL port times 10 plus 1, e.g.
+33061 for 3306, which is only possible for a MySQL port up to 6553
+*/
+func defaultGCSAddress(host string, port string) (string, error) {
+	p, err := strconv.Atoi(port)
+
+	if err != nil || p*10+1 > 65535 {
+		return "", fmt.Errorf("no gcs_address was given, and there's no default for the MySQL port %s", port)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(p*10+1)), nil
+}
+
+// readSimulation decodes a hypothetical cluster, refusing any fields that we don't know about
+func readSimulation(r io.Reader) (simCluster, error) {
+	var cluster simCluster
+
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&cluster)
+
+	return cluster, err
+}
+
+// This will simulate the decision for a hypothetical cluster, POSTed as JSON, via a simple RESTful API
+func simulateHandler(httpW http.ResponseWriter, httpR *http.Request) {
+	if httpR.Method != http.MethodPost {
+		httpW.Header().Set("Allow", http.MethodPost)
+		http.Error(httpW, "A hypothetical cluster can only be simulated with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	Log.Debug("Handling HTTP request to simulate")
+
+	cluster, err := readSimulation(io.LimitReader(httpR.Body, 1<<20))
+
+	if err == nil {
+		var result simResult
+
+		if result, err = simulate(cluster); err == nil {
+			resultJSON, jerr := json.MarshalIndent(result, "", "    ")
+
+			if jerr != nil {
+				Log.Error("Error handling HTTP request to simulate", logging.KeyError, jerr)
+			}
+
+			httpW.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(httpW, "%s", resultJSON)
+			return
+		}
+	}
+
+	http.Error(httpW, "Invalid hypothetical cluster: "+err.Error(), http.StatusBadRequest)
+}
+
+func simulateCommand(args []string) int {
+	cmdFlags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	path := cmdFlags.String("file", "", "The JSON file describing the hypothetical cluster, it can also be given as an argument, - reads it from stdin")
+	format := cmdFlags.String("format", "text", "The format of the decision: text or json")
+	cmdFlags.IntVar(&minOnlineMembers, "min-online-members", minOnlineMembers, "The -min-online-members to simulate, unless the cluster's min_online_members is given")
+	cmdFlags.DurationVar(&forceConfirmDelay, "force-confirm-delay", 0, "The -force-confirm-delay to simulate")
+	cmdFlags.BoolVar(&forceApproval, "force-approval", false, "The -force-approval to simulate")
+	cmdFlags.Parse(args)
+
+	if *path == "" && cmdFlags.NArg() > 0 {
+		*path = cmdFlags.Arg(0)
+	}
+
+	if *path == "" || (*format != "text" && *format != "json") {
+		fmt.Fprintf(os.Stderr, "Usage of %s simulate:\n", os.Args[0])
+		cmdFlags.PrintDefaults()
+		return 1
+	}
+
+	// we're only simulating, so there's nothing worth logging
+	Log, _ = logging.New(ioutil.Discard, logging.FormatLogfmt, slog.LevelError)
+
+	in := os.Stdin
+
+	if *path != "-" {
+		file, err := os.Open(*path)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read the hypothetical cluster: %v\n", err)
+			return 1
+		}
+
+		defer file.Close()
+		in = file
+	}
+
+	cluster, err := readSimulation(in)
+
+	if err == nil {
+		var result simResult
+
+		if result, err = simulate(cluster); err == nil {
+			if *format == "json" {
+				resultJSON, _ := json.MarshalIndent(result, "", "    ")
+				fmt.Printf("%s\n", resultJSON)
+			} else {
+				printSimulation(result)
+			}
+
+			return 0
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Invalid hypothetical cluster: %v\n", err)
+
+	return 1
+}
+
+// printSimulation writes the decision out for a human
+func printSimulation(result simResult) {
+	fmt.Printf("Decision: %s\n", result.Decision)
+
+	if result.Seed != "" {
+		fmt.Printf("Seed node: %s (quorum: %t)\n", result.Seed, result.SeedQuorum)
+	}
+
+	if result.ForceMembers != "" {
+		fmt.Printf("Force members: %s\n", result.ForceMembers)
+	}
+
+	fmt.Printf("\n%s\nWhy:\n", result.Matrix)
+
+	for _, reason := range result.Reasons {
+		fmt.Printf("  - %s\n", reason)
+	}
+
+	if len(result.Actions) > 0 {
+		fmt.Printf("\nActions:\n")
+	}
+
+	for _, act := range result.Actions {
+		line := "  - " + act.Action + " " + act.Node + ": " + act.Reason
+
+		if act.Refused != "" {
+			line += " [REFUSED: " + act.Refused + "]"
+		}
+
+		fmt.Println(strings.TrimSpace(line))
+	}
+}
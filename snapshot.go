@@ -0,0 +1,43 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// Snapshot is what we observed of the cluster during a loop, our decisions and actions are based on it
+type Snapshot struct {
+	Time       string       `json:"Time"`
+	Loop       uint         `json:"Loop"`
+	Seed       group.Node   `json:"Seed Node"`
+	SeedQuorum bool         `json:"Seed Has Quorum"`
+	View       []group.Node `json:"Membership View"`
+	// Reachability is the latest probe of each member's MySQL and XCom ports
+	Reachability []memberProbe `json:"Reachability,omitempty"`
+}
+
+// newSnapshot copies the view, so that the snapshot isn't changed by anything we do with the nodes afterwards
+func newSnapshot(loop uint, seed group.Node, seedQuorum bool, view []group.Node) Snapshot {
+	snap := Snapshot{Time: time.Now().Format(time.RFC3339Nano), Loop: loop, Seed: seed, SeedQuorum: seedQuorum, Reachability: latestProbes()}
+	snap.View = make([]group.Node, len(view))
+	copy(snap.View, view)
+
+	return snap
+}
@@ -0,0 +1,201 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// stateVersion is the format of the state file, it's bumped for any incompatible changes
+const stateVersion = 1
+
+/*
+savedState is what we persist to the state file after each loop, so that when we're restarted while the seed node is
+down we can still find the cluster via the last known membership view. No passwords are included, the Node type
+doesn't export them.
+*/
+type savedState struct {
+	Version    int          `json:"Version"`
+	Saved      time.Time    `json:"Saved"`
+	Loop       uint         `json:"Loop"`
+	Cluster    string       `json:"Cluster"`
+	Seed       group.Node   `json:"Seed Node"`
+	SeedQuorum bool         `json:"Seed Has Quorum"`
+	View       []group.Node `json:"Membership View"`
+	// the circuit breaker's budget, so that restarting us doesn't give a misbehaving network a fresh one
+	Breaker map[string]*clusterBudget `json:"Circuit Breaker,omitempty"`
+}
+
+// stateFile is where we persist our state, it's disabled when empty
+var stateFile string
+
+// saveState atomically replaces the state file, so that a crash mid-write can never leave a partial file behind
+func saveState(path string, state savedState) error {
+	if path == "" {
+		return nil
+	}
+
+	state.Version = stateVersion
+	state.Saved = time.Now()
+
+	contents, err := json.MarshalIndent(&state, "", "    ")
+
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	// this is a no-op once the rename has succeeded
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(append(contents, '\n')); err == nil {
+		err = tmp.Sync()
+	}
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// and let's make sure that the rename itself is durable
+	if d, derr := os.Open(dir); derr == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// loadState reads the state file, refusing one older than maxAge as the cluster has likely changed too much since
+func loadState(path string, maxAge time.Duration) (savedState, error) {
+	var state savedState
+
+	contents, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return state, err
+	}
+
+	if err = json.Unmarshal(contents, &state); err != nil {
+		return state, fmt.Errorf("Could not parse the state file %s: %v", path, err)
+	}
+
+	if state.Version != stateVersion {
+		return state, fmt.Errorf("The state file %s has version %d, but version %d is required", path, state.Version, stateVersion)
+	}
+
+	if age := time.Since(state.Saved); maxAge > 0 && age > maxAge {
+		return state, fmt.Errorf("The state file %s is stale, it was saved %v ago and the limit is %v", path, age.Round(time.Second), maxAge)
+	}
+
+	return state, nil
+}
+
+/*
+restoreView returns the membership view from the state file, to use as the fallback seed nodes when the one given on
+the command-line is down. The seed node from the state file is included, and anything that can't be used is logged
+and ignored, so that we never fail to start because of the state file.
+*/
+func restoreView(path string, maxAge time.Duration) []group.Node {
+	var view []group.Node
+
+	if path == "" {
+		return view
+	}
+
+	state, err := loadState(path, maxAge)
+
+	if os.IsNotExist(err) {
+		Log.Info("No state file found, starting without a previous membership view", "file", path)
+		return view
+	}
+
+	if err != nil {
+		Log.Warn("Not using the previous membership view from the state file", "file", path, logging.KeyError, err)
+		return view
+	}
+
+	view = append(view, state.View...)
+	seedKnown := false
+
+	for _, node := range view {
+		if node.MySQLHost == state.Seed.MySQLHost && node.MySQLPort == state.Seed.MySQLPort {
+			seedKnown = true
+			break
+		}
+	}
+
+	if !seedKnown && state.Seed.MySQLHost != "" {
+		view = append([]group.Node{state.Seed}, view...)
+	}
+
+	Log.Info("Restored the previous membership view from the state file", "file", path, logging.KeyCluster, state.Cluster, "nodes", len(view), "saved", state.Saved.Format(time.RFC3339))
+
+	return view
+}
+
+/*
+restoreBreaker restores the circuit breaker's state for each cluster from the state file. A stale state file is still
+used for this, as an open breaker has to stay open until it's reset, and the actions taken before the window are
+forgotten anyway the next time that the budget is checked.
+*/
+func restoreBreaker(path string) {
+	if path == "" {
+		return
+	}
+
+	state, err := loadState(path, 0)
+
+	if err != nil || len(state.Breaker) == 0 {
+		return
+	}
+
+	breaker.Lock()
+	for name, budget := range state.Breaker {
+		if budget.Actions == nil {
+			budget.Actions = make(map[string][]time.Time)
+		}
+
+		breaker.clusters[name] = budget
+
+		if budget.Open {
+			Log.Warn("The circuit breaker is still open from before we were restarted, we're advisory-only for the cluster until it's reset", logging.KeyCluster, name, "reason", budget.Reason)
+		}
+	}
+	breaker.Unlock()
+}
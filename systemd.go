@@ -0,0 +1,95 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mattlord/myarbitratord/daemon"
+	"github.com/mattlord/myarbitratord/logging"
+)
+
+// the last status that we sent to systemd, so that we only send it again when it changes
+var lastStatus struct {
+	sync.Mutex
+	status string
+}
+
+// notifyStatus tells systemd what we're currently doing, which is shown by "systemctl status myarbitratord"
+func notifyStatus(status string) {
+	lastStatus.Lock()
+	defer lastStatus.Unlock()
+
+	if status == lastStatus.status {
+		return
+	}
+
+	lastStatus.status = status
+
+	if _, err := daemon.Notify(daemon.Status(status)); err != nil {
+		Log.Debug("Could not send the status to systemd", logging.KeyError, err)
+	}
+}
+
+// notifyReady tells systemd that we've started up, and starts the watchdog keepalives if they're enabled for us
+func notifyReady() {
+	sent, err := daemon.Notify(daemon.Ready, daemon.Status("Starting to monitor the cluster"))
+
+	if err != nil {
+		Log.Error("Could not notify systemd that we're ready", logging.KeyError, err)
+	}
+
+	if !sent {
+		return
+	}
+
+	interval, err := daemon.WatchdogInterval()
+
+	if err != nil {
+		Log.Error("Invalid systemd watchdog interval", logging.KeyError, err)
+	}
+
+	if interval > 0 {
+		Log.Info("Sending keepalives to the systemd watchdog", "watchdog_interval", interval)
+		go watchdog(interval / 2)
+	}
+}
+
+// notifyStopping tells systemd that we've begun shutting down
+func notifyStopping() {
+	if _, err := daemon.Notify(daemon.Stopping, daemon.Status("Shutting down")); err != nil {
+		Log.Error("Could not notify systemd that we're stopping", logging.KeyError, err)
+	}
+}
+
+/*
+watchdog sends the keepalives to systemd, but only while the monitoring loop is making progress. If it gets stuck
+then systemd will kill us after WatchdogSec, and restart us as the unit has Restart=on-failure.
+*/
+func watchdog(interval time.Duration) {
+	for range time.Tick(interval) {
+		if alive, since, _ := health.alive(); !alive {
+			Log.Warn("The monitoring loop is not progressing, withholding the systemd watchdog keepalive", "last_loop", since)
+			continue
+		}
+
+		if _, err := daemon.Notify(daemon.Watchdog); err != nil {
+			Log.Error("Could not send the keepalive to the systemd watchdog", logging.KeyError, err)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+/*
+  Copyright 2017 Matthew Lord (mattalord@gmail.com)
+
+  WARNING: This is experimental and for demonstration purposes only!
+
+  Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+   1. Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+   2. Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+   3. Neither the name of the copyright holder nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+   THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mattlord/myarbitratord/logging"
+	"github.com/mattlord/myarbitratord/replication/group"
+)
+
+// The diagnoses of a member, from probing both its MySQL and its GCS/XCom port
+const (
+	probeOK = "OK"
+	// neither port is reachable, so mysqld is down (or the host is unreachable)
+	probeMySQLDown = "MYSQLD_DOWN"
+	// mysqld is up but its group communication isn't, so the partition is at the XCom layer
+	probeGCSBroken = "GCS_LINK_BROKEN"
+	// the group communication is up but mysqld isn't accepting connections
+	probeMySQLUnreachable = "MYSQL_UNREACHABLE"
+	// we've yet to learn the member's GCS endpoint, which we can only do while mysqld is up
+	probeUnknown = "UNKNOWN"
+)
+
+// memberProbe is what we found when probing one member's ports, it's part of each snapshot
+type memberProbe struct {
+	Endpoint       string `json:"Endpoint"`
+	ServerUUID     string `json:"Server UUID,omitempty"`
+	MySQLReachable bool   `json:"MySQL Reachable"`
+	GCSEndpoint    string `json:"GCS Endpoint,omitempty"`
+	XComReachable  bool   `json:"XCom Reachable"`
+	Diagnosis      string `json:"Diagnosis"`
+	Error          string `json:"Error,omitempty"`
+	// when the member was probed, as the latest probes can be up to -xcom-probe-interval old while the group is healthy
+	Time time.Time `json:"Probed At"`
+}
+
+// the XCom port probe settings, see the flags in main
+var (
+	probeXCom     = true
+	probeInterval = time.Minute
+)
+
+/*
+The GCS endpoint of each member, by server UUID, which is only available from the member's own mysqld. So we remember
+it, to still be able to probe the XCom port once mysqld is down. Along with the latest probe of each member, the
+diagnosis we last logged for it, and when the members were last probed.
+*/
+var xcomProbes = struct {
+	sync.Mutex
+	endpoints map[string]group.GCSEndpoint
+	latest    []memberProbe
+	logged    map[string]string
+	lastRun   time.Time
+}{endpoints: make(map[string]group.GCSEndpoint), logged: make(map[string]string)}
+
+/*
+probeMembers probes the MySQL and XCom ports of each member at the TCP level, all at once, noting when a diagnosis
+changes. While the seed node has a quorum, the members are only probed every -xcom-probe-interval, which is enough to
+learn their GCS endpoints ahead of a partition, and nil is returned when they weren't probed this time.
+*/
+func probeMembers(logger *slog.Logger, members []group.Node, quorum bool) []memberProbe {
+	if !probeXCom {
+		return nil
+	}
+
+	forgetProbes(members)
+
+	xcomProbes.Lock()
+	due := !quorum || time.Since(xcomProbes.lastRun) >= probeInterval
+	if due {
+		xcomProbes.lastRun = time.Now()
+	}
+	xcomProbes.Unlock()
+
+	if !due {
+		return nil
+	}
+
+	probes := make([]memberProbe, len(members))
+	var wg sync.WaitGroup
+
+	for i := range members {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			probes[i] = probeMember(members[i])
+		}(i)
+	}
+
+	wg.Wait()
+
+	xcomProbes.Lock()
+	xcomProbes.latest = probes
+
+	for i, probe := range probes {
+		if xcomProbes.logged[probe.Endpoint] == probe.Diagnosis {
+			continue
+		}
+
+		if probe.Diagnosis == probeOK || probe.Diagnosis == probeUnknown {
+			nodeLogger(logger, &members[i]).Info("Member probe", "diagnosis", probe.Diagnosis, "gcs_endpoint", probe.GCSEndpoint)
+		} else {
+			nodeLogger(logger, &members[i]).Warn("Member probe", "diagnosis", probe.Diagnosis, "gcs_endpoint", probe.GCSEndpoint, "mysql_reachable", probe.MySQLReachable, "xcom_reachable", probe.XComReachable, logging.KeyError, probe.Error)
+		}
+
+		xcomProbes.logged[probe.Endpoint] = probe.Diagnosis
+	}
+	xcomProbes.Unlock()
+
+	return probes
+}
+
+// forgetProbes forgets the GCS endpoints, and the logged diagnoses, of the members that are no longer in the group
+func forgetProbes(members []group.Node) {
+	uuids := make(map[string]bool, len(members))
+	endpoints := make(map[string]bool, len(members))
+
+	for _, member := range members {
+		uuids[member.ServerUuid] = true
+		endpoints[net.JoinHostPort(member.MySQLHost, member.MySQLPort)] = true
+	}
+
+	xcomProbes.Lock()
+	defer xcomProbes.Unlock()
+
+	for uuid := range xcomProbes.endpoints {
+		if !uuids[uuid] {
+			delete(xcomProbes.endpoints, uuid)
+		}
+	}
+
+	for endpoint := range xcomProbes.logged {
+		if !endpoints[endpoint] {
+			delete(xcomProbes.logged, endpoint)
+		}
+	}
+}
+
+func probeMember(member group.Node) memberProbe {
+	probe := memberProbe{Endpoint: net.JoinHostPort(member.MySQLHost, member.MySQLPort), ServerUUID: member.ServerUuid, Time: time.Now()}
+
+	err := dial(probe.Endpoint)
+	probe.MySQLReachable = err == nil
+
+	xcomProbes.Lock()
+	endpoint, known := xcomProbes.endpoints[member.ServerUuid]
+	xcomProbes.Unlock()
+
+	if !known && probe.MySQLReachable {
+		if learned, lerr := learnGCSEndpoint(member); lerr == nil {
+			endpoint, known = learned, true
+		}
+	}
+
+	if !known {
+		probe.Diagnosis = probeUnknown
+
+		if err != nil {
+			probe.Error = err.Error()
+		}
+
+		return probe
+	}
+
+	xerr := dial(endpoint.String())
+
+	// the member may have been restarted with a different GCS endpoint, so we check that while mysqld is up
+	if xerr != nil && probe.MySQLReachable {
+		if learned, lerr := learnGCSEndpoint(member); lerr == nil && learned != endpoint {
+			endpoint = learned
+			xerr = dial(endpoint.String())
+		}
+	}
+
+	probe.GCSEndpoint = endpoint.String()
+	probe.XComReachable = xerr == nil
+
+	switch {
+	case probe.MySQLReachable && probe.XComReachable:
+		probe.Diagnosis = probeOK
+	case probe.MySQLReachable:
+		probe.Diagnosis = probeGCSBroken
+		probe.Error = xerr.Error()
+	case probe.XComReachable:
+		probe.Diagnosis = probeMySQLUnreachable
+		probe.Error = err.Error()
+	default:
+		probe.Diagnosis = probeMySQLDown
+		probe.Error = err.Error()
+	}
+
+	return probe
+}
+
+// learnGCSEndpoint gets the member's GCS endpoint from its mysqld, and remembers it
+func learnGCSEndpoint(member group.Node) (group.GCSEndpoint, error) {
+	err := member.Connect()
+	noteConnectResult(&member, err)
+	defer member.Cleanup()
+
+	if err != nil {
+		return group.GCSEndpoint{}, err
+	}
+
+	endpoint, err := member.GetGCSEndpoint()
+
+	if err == nil {
+		xcomProbes.Lock()
+		xcomProbes.endpoints[member.ServerUuid] = endpoint
+		xcomProbes.Unlock()
+	}
+
+	return endpoint, err
+}
+
+// dial checks that the endpoint accepts a TCP connection, within the XCom probe timeout
+func dial(endpoint string) error {
+	conn, err := net.DialTimeout("tcp", endpoint, group.XComProbeTimeout)
+
+	if err == nil {
+		conn.Close()
+	}
+
+	return err
+}
+
+// latestProbes returns a copy of the latest probe of each member
+func latestProbes() []memberProbe {
+	xcomProbes.Lock()
+	defer xcomProbes.Unlock()
+
+	if xcomProbes.latest == nil {
+		return nil
+	}
+
+	return append([]memberProbe{}, xcomProbes.latest...)
+}
+
+// probeSummary is each member's diagnosis, by its 'host:port'
+func probeSummary(probes []memberProbe) map[string]string {
+	summary := make(map[string]string)
+
+	for _, probe := range probes {
+		summary[probe.Endpoint] = probe.Diagnosis
+	}
+
+	return summary
+}